@@ -25,11 +25,9 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha256"
-	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"log"
-	"net/url"
 	"strconv"
 	"time"
 
@@ -38,17 +36,11 @@ import (
 )
 
 const (
-	kClientID    = "24C4853F-9398-41BD-B155-3333F181066B"
-	kRedirectURI = "https://local.vroov.com:9443/auth-cb"
-
-	kUser = "dude@intfoo.com"
-	kPwd  = "1234test"
-
 	kAuthGenRetries    = 10
 	kAuthCodeSize      = 32
 	kAuthRequestIDSize = 20
 
-	kAuthCodeCacheNamespace = "auth_code"
+	kAuthCodeCacheNamespace = services.AuthCodeNamespace
 
 	// QR Code generation
 	kQRTokenSize      = 16
@@ -57,11 +49,21 @@ const (
 )
 
 var (
-	kBadUserPasswordError = errors.New("invalid user or password")
+	kBadClientSecretError = errors.New("invalid client or secret")
+	kQRExpiredError       = errors.New("QR code has expired")
+	kQRSignatureError     = errors.New("QR code signature mismatch")
 )
 
+// What gets cached for each QR code token
+type qrSecret struct {
+	Key       string
+	RequestID string
+}
+
 type fixedAuthorizer struct {
-	store services.KeyValueStore
+	store   services.KeyValueStore
+	clients services.ClientRegistry
+	users   services.UserDirectory
 }
 
 func (v *fixedAuthorizer) GenerateAuthorizationRequest(data services.AuthCodeData, ttl time.Duration) (string, error) {
@@ -82,7 +84,7 @@ func (v *fixedAuthorizer) GenerateAuthorizationRequest(data services.AuthCodeDat
 	return "", err
 }
 
-func (v *fixedAuthorizer) GenerateQRRequest(ttl time.Duration) (string, string, string, error) {
+func (v *fixedAuthorizer) GenerateQRRequest(rid string, ttl time.Duration) (string, string, string, error) {
 	key, err := helpers.GenerateStringSecure(kQRSecretSize, helpers.AlphaNumeric)
 	if err != nil {
 		return "", "", "", err
@@ -95,7 +97,7 @@ func (v *fixedAuthorizer) GenerateQRRequest(ttl time.Duration) (string, string,
 			return "", "", "", err
 		}
 
-		err = v.store.CheckAndSet(kQRCacheNamespace, token, key, ttl)
+		err = v.store.CheckAndSet(kQRCacheNamespace, token, qrSecret{Key: key, RequestID: rid}, ttl)
 		if err == nil {
 			break
 		}
@@ -107,33 +109,81 @@ func (v *fixedAuthorizer) GenerateQRRequest(ttl time.Duration) (string, string,
 
 	ts := strconv.FormatInt(time.Now().Unix(), 10)
 
+	return ts, token, hex.EncodeToString(qrHash(key, ts, token)), nil
+}
+
+func (v *fixedAuthorizer) VerifyQRRequest(ts, token, hash string, ttl time.Duration) (string, error) {
+	tsSecs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", err
+	}
+
+	if time.Since(time.Unix(tsSecs, 0)) > ttl {
+		return "", kQRExpiredError
+	}
+
+	value, err := v.store.Read(kQRCacheNamespace, token)
+	if err != nil {
+		return "", err
+	}
+
+	secret, ok := value.(qrSecret)
+	if !ok {
+		return "", kQRSignatureError
+	}
+
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", err
+	}
+
+	if !hmac.Equal(qrHash(secret.Key, ts, token), expected) {
+		return "", kQRSignatureError
+	}
+
+	return secret.RequestID, nil
+}
+
+func qrHash(key, ts, token string) []byte {
 	hm := hmac.New(sha256.New, []byte(key))
 	hm.Write([]byte(ts))
 	hm.Write([]byte(token))
-	hash := hm.Sum(nil)
-
-	return ts, token, hex.EncodeToString(hash), nil
+	return hm.Sum(nil)
 }
 
 func (v *fixedAuthorizer) Authenticate(user, pwd string) (string, error) {
-	res := subtle.ConstantTimeCompare([]byte(kUser), []byte(user))
-	res += subtle.ConstantTimeCompare([]byte(kPwd), []byte(pwd))
-	if res != 2 {
-		return "", kBadUserPasswordError
+	u, err := v.users.Authenticate(user, pwd)
+	if err != nil {
+		return "", err
 	}
 
-	return "1", nil
+	return u.ID, nil
+}
+
+func (v *fixedAuthorizer) AuthenticateClient(cid, secret string) (services.Client, error) {
+	client, err := v.clients.Client(cid)
+	if err != nil || !client.VerifySecret(secret) {
+		return services.Client{}, kBadClientSecretError
+	}
+
+	return client, nil
 }
 
 func (v *fixedAuthorizer) ValidateClient(cid, redir string) bool {
-	redir, err := url.QueryUnescape(redir)
+	client, err := v.clients.Client(cid)
 	if err != nil {
-		log.Printf("Failed to unescape redirect URI - %v", err)
+		log.Printf("[Error] Unknown client (%s) - %v", cid, err)
 		return false
 	}
 
-	res := subtle.ConstantTimeCompare([]byte(kClientID), []byte(cid))
-	res += subtle.ConstantTimeCompare([]byte(kRedirectURI), []byte(redir))
+	return client.AllowsRedirect(redir)
+}
+
+func (v *fixedAuthorizer) UserClaims(uid string) (map[string]any, error) {
+	u, err := v.users.User(uid)
+	if err != nil {
+		return nil, err
+	}
 
-	return res == 2
+	return u.OIDCClaims(), nil
 }
@@ -33,7 +33,10 @@ const (
 )
 
 type ServicesConfig struct {
-	Auth auth.Config `json:"auth" yaml:"Auth"`
+	Auth    auth.Config       `json:"auth" yaml:"Auth"`
+	Clients []services.Client `json:"clients" yaml:"Clients"`
+	// YAML or JSON file of users (see 'mono user')
+	UsersFile string `json:"usersFile" yaml:"UsersFile"`
 }
 
 type MonoConfig struct {
@@ -46,7 +49,9 @@ func loadConfig() MonoConfig {
 	config := MonoConfig{
 		services.DefaultConfig(),
 		ServicesConfig{
-			Auth: auth.DefaultConfig(),
+			Auth:      auth.DefaultConfig(),
+			Clients:   []services.Client{defaultClient()},
+			UsersFile: "",
 		},
 	}
 
@@ -56,3 +61,13 @@ func loadConfig() MonoConfig {
 
 	return config
 }
+
+// The local development client; replaced by whatever the config file lists.
+func defaultClient() services.Client {
+	return services.Client{
+		ID:           "24C4853F-9398-41BD-B155-3333F181066B",
+		Type:         services.ClientTypePublic,
+		RedirectURIs: []string{"https://local.vroov.com:9443/auth-cb"},
+		Name:         "Local Development",
+	}
+}
@@ -25,6 +25,7 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 	"time"
 
 	"shiftylogic.dev/site-plat/internal/services"
@@ -35,13 +36,20 @@ func run() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatalf("[ERROR] %v", err)
+		}
+		return
+	}
+
 	ctx, shutdown := context.WithCancel(context.Background())
 
 	go func() {
 		defer shutdown()
 
-		svcs := loadServices(ctx)
 		config := loadConfig()
+		svcs := loadServices(ctx, config.Services)
 
 		options := selectMiddleware(config.Base)
 		options = append(options, services.WithServices(svcs))
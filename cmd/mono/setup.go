@@ -24,22 +24,37 @@ package main
 
 import (
 	"context"
+	"log"
 
 	"shiftylogic.dev/site-plat/internal/services"
 	"shiftylogic.dev/site-plat/internal/services/auth"
 	"shiftylogic.dev/site-plat/internal/web"
 )
 
-func loadServices(ctx context.Context) services.Services {
+func loadServices(ctx context.Context, config ServicesConfig) services.Services {
 	kvs := services.NewMemoryStore(ctx)
+	clients := services.NewClientRegistry(config.Clients, kvs)
+
+	users, err := services.LoadUserDirectory(config.UsersFile, kvs)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to load users file (%s) - %v", config.UsersFile, err)
+	}
+
+	if config.UsersFile == "" {
+		log.Print("[Warning] No users file configured; nobody will be able to sign in.")
+	}
 
 	return &services.ServicesContainer{
 		EphemeralStore: &services.SimpleDataStore{
 			KVS: kvs,
 		},
 		Authy: &fixedAuthorizer{
-			store: kvs,
+			store:   kvs,
+			clients: clients,
+			users:   users,
 		},
+		Registry:  clients,
+		Directory: users,
 	}
 }
 
@@ -0,0 +1,168 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+var (
+	kUnknownCommandError = errors.New("unknown command")
+	kMissingUsersFile    = errors.New("no users file; pass -file or set Services.UsersFile in the config")
+	kMissingUsername     = errors.New("missing username")
+	kEmptyPasswordError  = errors.New("password cannot be empty")
+	kUserNotFoundError   = errors.New("no such user")
+	kDuplicateUserError  = errors.New("username already taken")
+)
+
+const kUserUsage = `usage:
+  mono user add [-file users.yaml] [-name "Full Name"] [-email addr] <username>
+  mono user passwd [-file users.yaml] <username>
+  mono user list [-file users.yaml]
+
+Passwords are read from the first line of stdin.`
+
+// runCommand handles 'mono <command> ...' invocations that don't start the
+// server.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "user":
+		return runUserCommand(args[1:])
+	default:
+		return fmt.Errorf("%w: %s", kUnknownCommandError, args[0])
+	}
+}
+
+func runUserCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, kUserUsage)
+		return kUnknownCommandError
+	}
+
+	fs := flag.NewFlagSet("user "+args[0], flag.ContinueOnError)
+	file := fs.String("file", "", "users file (defaults to Services.UsersFile from the config)")
+	name := fs.String("name", "", "display name")
+	email := fs.String("email", "", "email address")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		*file = loadConfig().Services.UsersFile
+	}
+	if *file == "" {
+		return kMissingUsersFile
+	}
+
+	users, err := services.ReadUsersFile(*file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		if fs.NArg() != 1 {
+			return kMissingUsername
+		}
+
+		if _, exists := users.Find(fs.Arg(0)); exists {
+			return kDuplicateUserError
+		}
+
+		pwd, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		user, err := services.NewUser(fs.Arg(0), pwd)
+		if err != nil {
+			return err
+		}
+
+		user.Name = *name
+		user.Email = *email
+
+		if err := users.Add(user); err != nil {
+			return err
+		}
+
+		fmt.Printf("Added %s (%s)\n", user.Username, user.ID)
+
+	case "passwd":
+		if fs.NArg() != 1 {
+			return kMissingUsername
+		}
+
+		i, ok := users.Find(fs.Arg(0))
+		if !ok {
+			return kUserNotFoundError
+		}
+
+		pwd, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		if err := users.Users[i].SetPassword(pwd); err != nil {
+			return err
+		}
+
+		fmt.Printf("Password set for %s\n", users.Users[i].Username)
+
+	case "list":
+		for _, u := range users.Users {
+			fmt.Printf("%s\t%s\t%s\n", u.ID, u.Username, u.Name)
+		}
+		return nil
+
+	default:
+		fmt.Fprintln(os.Stderr, kUserUsage)
+		return fmt.Errorf("%w: user %s", kUnknownCommandError, args[0])
+	}
+
+	return services.WriteUsersFile(*file, users)
+}
+
+func readPassword(in io.Reader) (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	pwd := strings.TrimRight(line, "\r\n")
+	if pwd == "" {
+		return "", kEmptyPasswordError
+	}
+
+	return pwd, nil
+}
@@ -30,8 +30,10 @@ import (
 )
 
 var (
-	kNoAuthorizationHeader = errors.New("no authorization header in request")
-	kNotBasicAuthorization = errors.New("authorization header is not basic")
+	kNoAuthorizationHeader  = errors.New("no authorization header in request")
+	kNotBasicAuthorization  = errors.New("authorization header is not basic")
+	kNotBearerAuthorization = errors.New("authorization header is not bearer")
+	kNotDPoPAuthorization   = errors.New("authorization header is not DPoP")
 )
 
 func ParseHttpAuthBasic(r *http.Request) (string, string, error) {
@@ -40,7 +42,7 @@ func ParseHttpAuthBasic(r *http.Request) (string, string, error) {
 		return "", "", kNoAuthorizationHeader
 	}
 
-	if strings.ToLower(val[:6]) != "basic " {
+	if len(val) < 6 || strings.ToLower(val[:6]) != "basic " {
 		return "", "", kNotBasicAuthorization
 	}
 
@@ -52,3 +54,29 @@ func ParseHttpAuthBasic(r *http.Request) (string, string, error) {
 	uid, pwd, _ := strings.Cut(string(dval), ":")
 	return uid, pwd, nil
 }
+
+func ParseHttpAuthBearer(r *http.Request) (string, error) {
+	val := r.Header.Get("Authorization")
+	if val == "" {
+		return "", kNoAuthorizationHeader
+	}
+
+	if len(val) < 7 || strings.ToLower(val[:7]) != "bearer " {
+		return "", kNotBearerAuthorization
+	}
+
+	return strings.TrimSpace(val[7:]), nil
+}
+
+func ParseHttpAuthDPoP(r *http.Request) (string, error) {
+	val := r.Header.Get("Authorization")
+	if val == "" {
+		return "", kNoAuthorizationHeader
+	}
+
+	if len(val) < 5 || strings.ToLower(val[:5]) != "dpop " {
+		return "", kNotDPoPAuthorization
+	}
+
+	return strings.TrimSpace(val[5:]), nil
+}
@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/**
+ *
+ * Password hashing (PBKDF2-HMAC-SHA256, RFC 8018)
+ *
+ * Hashes are encoded with their parameters so the cost can be raised later;
+ * VerifyPassword reports when a stored hash is weaker than current settings
+ * and should be replaced with a fresh HashPassword result.
+ *
+ *   $pbkdf2-sha256$i=<iterations>$<salt>$<key>   (salt / key are base64url)
+ *
+ **/
+
+const (
+	kPasswordScheme     = "pbkdf2-sha256"
+	kPasswordIterations = 600000
+	kPasswordSaltSize   = 16
+	kPasswordKeySize    = 32
+)
+
+var (
+	kUnknownPasswordSchemeError = errors.New("unknown password hash scheme")
+	kMalformedPasswordHashError = errors.New("malformed password hash")
+)
+
+func HashPassword(password string) (string, error) {
+	salt, err := GenerateBytesSecure(kPasswordSaltSize)
+	if err != nil {
+		return "", err
+	}
+
+	return encodePasswordHash(kPasswordIterations, salt, pbkdf2SHA256([]byte(password), salt, kPasswordIterations, kPasswordKeySize)), nil
+}
+
+// VerifyPassword checks password against an encoded hash. When it matches,
+// upgrade says whether the hash was made with weaker than current settings.
+func VerifyPassword(encoded, password string) (match bool, upgrade bool, err error) {
+	iterations, salt, key, err := decodePasswordHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+
+	computed := pbkdf2SHA256([]byte(password), salt, iterations, len(key))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+
+	return true, iterations < kPasswordIterations || len(salt) < kPasswordSaltSize, nil
+}
+
+func encodePasswordHash(iterations int, salt, key []byte) string {
+	return fmt.Sprintf(
+		"$%s$i=%d$%s$%s",
+		kPasswordScheme,
+		iterations,
+		base64.RawURLEncoding.EncodeToString(salt),
+		base64.RawURLEncoding.EncodeToString(key),
+	)
+}
+
+func decodePasswordHash(encoded string) (int, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 || parts[0] != "" {
+		return 0, nil, nil, kMalformedPasswordHashError
+	}
+
+	if parts[1] != kPasswordScheme {
+		return 0, nil, nil, kUnknownPasswordSchemeError
+	}
+
+	if !strings.HasPrefix(parts[2], "i=") {
+		return 0, nil, nil, kMalformedPasswordHashError
+	}
+
+	iterations, err := strconv.Atoi(parts[2][2:])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, kMalformedPasswordHashError
+	}
+
+	salt, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, nil, nil, kMalformedPasswordHashError
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, kMalformedPasswordHashError
+	}
+
+	return iterations, salt, key, nil
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018, Section 5.2) with HMAC-SHA256 as the PRF.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	var counter [4]byte
+	key := make([]byte, 0, blocks*hashLen)
+	u := make([]byte, hashLen)
+	t := make([]byte, hashLen)
+
+	for block := 1; block <= blocks; block++ {
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLen]
+}
@@ -0,0 +1,68 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package helpers
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+// Published PBKDF2-HMAC-SHA256 test vectors (same inputs as RFC 6070)
+func TestPBKDF2Vectors(t *testing.T) {
+	key := pbkdf2SHA256([]byte("password"), []byte("salt"), 1, 32)
+	test.Expect(t, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b", hex.EncodeToString(key), "1 iteration")
+
+	key = pbkdf2SHA256([]byte("password"), []byte("salt"), 4096, 32)
+	test.Expect(t, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a", hex.EncodeToString(key), "4096 iterations")
+
+	key = pbkdf2SHA256([]byte("passwordPASSWORDpassword"), []byte("saltSALTsaltSALTsaltSALTsaltSALTsalt"), 4096, 40)
+	test.Expect(t, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9", hex.EncodeToString(key), "multiple blocks")
+}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	encoded, err := HashPassword("correct horse")
+	test.NoError(t, err, "hashing password")
+	test.Require(t, strings.HasPrefix(encoded, "$pbkdf2-sha256$i="), "hash is self describing")
+
+	match, upgrade, err := VerifyPassword(encoded, "correct horse")
+	test.NoError(t, err, "verifying password")
+	test.Require(t, match && !upgrade, "current hash should match without upgrade")
+
+	match, _, err = VerifyPassword(encoded, "Correct horse")
+	test.NoError(t, err, "verifying wrong password")
+	test.Require(t, !match, "wrong password should not match")
+}
+
+func TestPasswordHashUpgrade(t *testing.T) {
+	weak := encodePasswordHash(1000, []byte("0123456789abcdef"), pbkdf2SHA256([]byte("pw"), []byte("0123456789abcdef"), 1000, 32))
+
+	match, upgrade, err := VerifyPassword(weak, "pw")
+	test.NoError(t, err, "verifying weak hash")
+	test.Require(t, match && upgrade, "weak hash should match and ask for an upgrade")
+
+	_, _, err = VerifyPassword("$bcrypt$whatever$x$y", "pw")
+	test.SpecificError(t, err, kUnknownPasswordSchemeError, "unknown scheme")
+}
@@ -0,0 +1,135 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/**
+ *
+ * Time-based one-time passwords (RFC 6238) with the parameters every
+ * authenticator app supports: HMAC-SHA1, 6 digits, 30 second steps.
+ *
+ **/
+
+const (
+	TOTPStep = 30 * time.Second
+
+	kTOTPDigits     = 6
+	kTOTPSecretSize = 20
+)
+
+var kTOTPEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new shared secret, base32 encoded the way
+// authenticator apps expect it.
+func GenerateTOTPSecret() (string, error) {
+	key, err := GenerateBytesSecure(kTOTPSecretSize)
+	if err != nil {
+		return "", err
+	}
+
+	return kTOTPEncoding.EncodeToString(key), nil
+}
+
+// TOTPCounter is the time step t falls in.
+func TOTPCounter(t time.Time) int64 {
+	return t.Unix() / int64(TOTPStep/time.Second)
+}
+
+func TOTPCode(secret string, counter int64) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", kTOTPDigits, hotp(key, uint64(counter), kTOTPDigits)), nil
+}
+
+// VerifyTOTP checks code against the steps within skew of now and returns
+// the counter it matched, so callers can refuse to accept it twice.
+func VerifyTOTP(secret, code string, now time.Time, skew int) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != kTOTPDigits {
+		return 0, false
+	}
+
+	current := TOTPCounter(now)
+	for i := -skew; i <= skew; i++ {
+		counter := current + int64(i)
+		expected := fmt.Sprintf("%0*d", kTOTPDigits, hotp(key, uint64(counter), kTOTPDigits))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// TOTPProvisioningURI is the otpauth:// URI encoded in enrollment QR codes.
+func TOTPProvisioningURI(issuer, account, secret string) string {
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(kTOTPDigits))
+	query.Set("period", fmt.Sprint(int(TOTPStep/time.Second)))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	return kTOTPEncoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// hotp is RFC 4226 (Section 5.3), including dynamic truncation.
+func hotp(key []byte, counter uint64, digits int) uint32 {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+
+	return value % mod
+}
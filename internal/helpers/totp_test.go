@@ -0,0 +1,64 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package helpers
+
+import (
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+// RFC 6238 (Appendix B) SHA1 vectors, which use 8 digits
+func TestTOTPVectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := map[int64]uint32{
+		59:          94287082,
+		1111111109:  7081804,
+		1111111111:  14050471,
+		1234567890:  89005924,
+		2000000000:  69279037,
+		20000000000: 65353130,
+	}
+
+	for ts, expected := range vectors {
+		counter := TOTPCounter(time.Unix(ts, 0))
+		test.Expect(t, expected, hotp(key, uint64(counter), 8), "RFC 6238 vector")
+	}
+}
+
+func TestTOTPVerifySkew(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	test.NoError(t, err, "generating secret")
+
+	now := time.Unix(1700000000, 0)
+	prev, err := TOTPCode(secret, TOTPCounter(now)-1)
+	test.NoError(t, err, "generating code")
+
+	counter, ok := VerifyTOTP(secret, prev, now, 1)
+	test.Require(t, ok, "previous step is inside a skew of one")
+	test.Expect(t, TOTPCounter(now)-1, counter, "matched counter is reported")
+
+	_, ok = VerifyTOTP(secret, prev, now, 0)
+	test.Require(t, !ok, "previous step is outside a skew of zero")
+}
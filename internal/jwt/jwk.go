@@ -0,0 +1,205 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+)
+
+const (
+	kKeyTypeRSA = "RSA"
+	kKeyTypeEC  = "EC"
+	kKeyTypeOKP = "OKP"
+
+	kCurveP256    = "P-256"
+	kCurveEd25519 = "Ed25519"
+
+	kUseSignature = "sig"
+)
+
+var (
+	kErrorSymmetricJWK = errors.New("symmetric keys cannot be published")
+	kErrorUnknownJWK   = errors.New("unsupported JWK key type")
+	kErrorInvalidJWK   = errors.New("malformed JWK key material")
+)
+
+/**
+ *
+ * JSON Web Keys (RFC 7517). Only the public members of the supported key
+ * types are modeled.
+ *
+ **/
+type JWK struct {
+	KeyType   string `json:"kty" yaml:"kty"`
+	KeyID     string `json:"kid,omitempty" yaml:"kid,omitempty"`
+	Use       string `json:"use,omitempty" yaml:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty" yaml:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty" yaml:"n,omitempty"`
+	E string `json:"e,omitempty" yaml:"e,omitempty"`
+
+	// EC and OKP
+	Curve string `json:"crv,omitempty" yaml:"crv,omitempty"`
+	X     string `json:"x,omitempty" yaml:"x,omitempty"`
+	Y     string `json:"y,omitempty" yaml:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys" yaml:"keys"`
+}
+
+// JWK returns the public half of an asymmetric key.
+func (k *Key) JWK() (JWK, error) {
+	jwk := JWK{KeyID: k.ID, Use: kUseSignature, Algorithm: k.Algorithm}
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = kKeyTypeRSA
+		jwk.N = b64.EncodeToString(pub.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+
+	case *ecdsa.PublicKey:
+		x := make([]byte, kES256KeySize)
+		y := make([]byte, kES256KeySize)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+
+		jwk.KeyType = kKeyTypeEC
+		jwk.Curve = kCurveP256
+		jwk.X = b64.EncodeToString(x)
+		jwk.Y = b64.EncodeToString(y)
+
+	case ed25519.PublicKey:
+		jwk.KeyType = kKeyTypeOKP
+		jwk.Curve = kCurveEd25519
+		jwk.X = b64.EncodeToString(pub)
+
+	default:
+		return JWK{}, kErrorSymmetricJWK
+	}
+
+	return jwk, nil
+}
+
+// PublicKey turns a published JWK back into a verification key for alg.
+func (j JWK) PublicKey(alg string) (*Key, error) {
+	var public any
+
+	switch j.KeyType {
+	case kKeyTypeRSA:
+		n, errN := b64.DecodeString(j.N)
+		e, errE := b64.DecodeString(j.E)
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, kErrorInvalidJWK
+		}
+
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+	case kKeyTypeEC:
+		x, errX := b64.DecodeString(j.X)
+		y, errY := b64.DecodeString(j.Y)
+		if j.Curve != kCurveP256 || errX != nil || errY != nil || len(x) != kES256KeySize || len(y) != kES256KeySize {
+			return nil, kErrorInvalidJWK
+		}
+
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, kErrorInvalidJWK
+		}
+
+		public = pub
+
+	case kKeyTypeOKP:
+		x, err := b64.DecodeString(j.X)
+		if j.Curve != kCurveEd25519 || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, kErrorInvalidJWK
+		}
+
+		public = ed25519.PublicKey(x)
+
+	default:
+		return nil, kErrorUnknownJWK
+	}
+
+	return NewPublicKey(j.KeyID, alg, public)
+}
+
+// Thumbprint computes the RFC 7638 SHA-256 thumbprint of the key. It only
+// depends on the key material, so it makes a stable key ID.
+func (k *Key) Thumbprint() (string, error) {
+	jwk, err := k.JWK()
+	if err != nil {
+		return "", err
+	}
+
+	return jwk.Thumbprint()
+}
+
+func (j JWK) Thumbprint() (string, error) {
+	// The required members, in lexicographic order, with no whitespace.
+	// Marshaling a struct keeps field order, which is why these are ordered.
+	var members any
+
+	switch j.KeyType {
+	case kKeyTypeRSA:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{j.E, j.KeyType, j.N}
+
+	case kKeyTypeEC:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{j.Curve, j.KeyType, j.X, j.Y}
+
+	case kKeyTypeOKP:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{j.Curve, j.KeyType, j.X}
+
+	default:
+		return "", kErrorUnknownJWK
+	}
+
+	data, err := json.Marshal(members)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return b64.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,73 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jwt
+
+import (
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestThumbprintRFC7638(t *testing.T) {
+	// Example from RFC 7638 (Section 3.1)
+	jwk := JWK{
+		KeyType: "RSA",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjB" +
+			"ZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8" +
+			"KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_x" +
+			"BniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:     "AQAB",
+		KeyID: "2011-04-29",
+	}
+
+	tp, err := jwk.Thumbprint()
+	test.NoError(t, err, "thumbprint failed")
+	test.Expect(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", tp, "RFC 7638 thumbprint")
+}
+
+func TestPublicJWK(t *testing.T) {
+	for _, key := range testKeys(t) {
+		jwk, err := key.JWK()
+		if key.Algorithm == HS256 {
+			test.SpecificError(t, err, kErrorSymmetricJWK, "HMAC keys must not be published")
+			continue
+		}
+
+		test.NoError(t, err, "JWK export failed for "+key.Algorithm)
+		test.Expect(t, key.Algorithm, jwk.Algorithm, "alg should be carried over")
+
+		a, err := key.Thumbprint()
+		test.NoError(t, err, "thumbprint failed for "+key.Algorithm)
+		b, err := key.Public().Thumbprint()
+		test.NoError(t, err, "thumbprint failed for public "+key.Algorithm)
+		test.Expect(t, a, b, "thumbprint should only depend on the public key")
+
+		parsed, err := jwk.PublicKey(key.Algorithm)
+		test.NoError(t, err, "JWK import failed for "+key.Algorithm)
+		token, err := Sign(key, RegisteredClaims{Subject: "dude"})
+		test.NoError(t, err, "sign failed for "+key.Algorithm)
+		parsedToken, err := Parse(token)
+		test.NoError(t, err, "parse failed for "+key.Algorithm)
+		test.NoError(t, parsedToken.Verify(parsed), "imported JWK should verify for "+key.Algorithm)
+	}
+}
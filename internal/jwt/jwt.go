@@ -0,0 +1,223 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jwt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	TypeJWT = "JWT"
+)
+
+var (
+	kErrorMalformedToken = errors.New("malformed token")
+	kErrorUnknownKey     = errors.New("no key matches token header")
+)
+
+var b64 = base64.RawURLEncoding
+
+type Header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+
+	// The signer's public key, carried in the header by self-contained
+	// proofs such as DPoP (RFC 9449)
+	JWK *JWK `json:"jwk,omitempty"`
+}
+
+/**
+ *
+ * A parsed, but not yet verified, compact JWS.
+ *
+ **/
+type Token struct {
+	Header Header
+
+	raw       string
+	payload   []byte
+	signature []byte
+}
+
+// Sign produces a compact JWS over the JSON encoding of claims.
+func Sign(key *Key, claims any) (string, error) {
+	return SignWithHeader(key, Header{Type: TypeJWT}, claims)
+}
+
+// SignWithHeader is Sign with control over the JOSE header. The algorithm and
+// key ID are always taken from the key.
+func SignWithHeader(key *Key, header Header, claims any) (string, error) {
+	header.Algorithm = key.Algorithm
+	header.KeyID = key.ID
+
+	hdr, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64.EncodeToString(hdr) + "." + b64.EncodeToString(payload)
+	sig, err := key.Sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + b64.EncodeToString(sig), nil
+}
+
+// Parse splits and decodes a compact JWS without checking its signature.
+func Parse(raw string) (*Token, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, kErrorMalformedToken
+	}
+
+	hdr, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, kErrorMalformedToken
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, kErrorMalformedToken
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, kErrorMalformedToken
+	}
+
+	token := &Token{raw: raw, payload: payload, signature: sig}
+	if err := json.Unmarshal(hdr, &token.Header); err != nil {
+		return nil, kErrorMalformedToken
+	}
+
+	return token, nil
+}
+
+// Verify checks the signature against a key. The header algorithm must match
+// the key's algorithm so a token can never pick how it is verified.
+func (t *Token) Verify(key *Key) error {
+	if t.Header.Algorithm != key.Algorithm {
+		return kErrorKeyAlgorithmMismatch
+	}
+
+	input := t.raw[:strings.LastIndexByte(t.raw, '.')]
+	return key.Verify([]byte(input), t.signature)
+}
+
+func (t *Token) Claims(v any) error {
+	dec := json.NewDecoder(bytes.NewReader(t.payload))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func (t *Token) String() string {
+	return t.raw
+}
+
+/**
+ *
+ * A Verifier checks signature, lifetime, issuer and (optionally) audience
+ * before decoding the claims for the caller.
+ *
+ **/
+type Verifier struct {
+	Keys     []*Key
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+
+	// Now is used for lifetime checks; it defaults to time.Now
+	Now func() time.Time
+}
+
+func (v *Verifier) Verify(raw string, claims any) (*Token, error) {
+	token, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	key := v.keyFor(token.Header)
+	if key == nil {
+		return nil, kErrorUnknownKey
+	}
+
+	if err := token.Verify(key); err != nil {
+		return nil, err
+	}
+
+	var registered RegisteredClaims
+	if err := token.Claims(&registered); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+
+	if err := registered.Validate(now, v.Leeway); err != nil {
+		return nil, err
+	}
+
+	if v.Issuer != "" && registered.Issuer != v.Issuer {
+		return nil, kErrorInvalidIssuer
+	}
+
+	if v.Audience != "" && !registered.Audience.Contains(v.Audience) {
+		return nil, kErrorInvalidAudience
+	}
+
+	if claims != nil {
+		if err := token.Claims(claims); err != nil {
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+func (v *Verifier) keyFor(header Header) *Key {
+	for _, k := range v.Keys {
+		if k.Algorithm != header.Algorithm {
+			continue
+		}
+
+		if header.KeyID == "" || k.ID == header.KeyID {
+			return k
+		}
+	}
+
+	return nil
+}
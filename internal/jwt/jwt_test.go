@@ -0,0 +1,140 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+type testClaims struct {
+	RegisteredClaims
+	Scope string `json:"scope"`
+}
+
+func testKeys(t *testing.T) []*Key {
+	t.Helper()
+
+	hk, err := NewHMACKey("hs", []byte("0123456789abcdef0123456789abcdef"))
+	test.NoError(t, err, "failed to create HMAC key")
+
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	test.NoError(t, err, "failed to generate RSA key")
+	rsk, err := NewPrivateKey("rs", RS256, rk)
+	test.NoError(t, err, "failed to wrap RSA key")
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.NoError(t, err, "failed to generate EC key")
+	esk, err := NewPrivateKey("es", ES256, ek)
+	test.NoError(t, err, "failed to wrap EC key")
+
+	_, edk, err := ed25519.GenerateKey(rand.Reader)
+	test.NoError(t, err, "failed to generate Ed25519 key")
+	edsk, err := NewPrivateKey("ed", EdDSA, edk)
+	test.NoError(t, err, "failed to wrap Ed25519 key")
+
+	return []*Key{hk, rsk, esk, edsk}
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	now := time.Now()
+
+	for _, key := range testKeys(t) {
+		claims := testClaims{
+			RegisteredClaims: RegisteredClaims{
+				Issuer:    "https://issuer",
+				Subject:   "1",
+				Audience:  Audience{"client"},
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(time.Minute).Unix(),
+			},
+			Scope: "read write",
+		}
+
+		raw, err := Sign(key, claims)
+		test.NoError(t, err, "sign failed for "+key.Algorithm)
+
+		v := Verifier{Keys: []*Key{key.Public()}, Issuer: "https://issuer", Audience: "client"}
+
+		var out testClaims
+		tok, err := v.Verify(raw, &out)
+		test.NoError(t, err, "verify failed for "+key.Algorithm)
+		test.Expect(t, key.ID, tok.Header.KeyID, "kid should be set in header")
+		test.Expect(t, claims, out, "claims should round trip for "+key.Algorithm)
+
+		// Flip a bit in the signature
+		tampered := []byte(raw)
+		tampered[len(tampered)-2] ^= 0x01
+		_, err = v.Verify(string(tampered), nil)
+		test.AnyError(t, err, "tampered token should not verify for "+key.Algorithm)
+	}
+}
+
+func TestVerifyRejectsBadClaims(t *testing.T) {
+	key := testKeys(t)[0]
+	now := time.Now()
+
+	raw, err := Sign(key, RegisteredClaims{
+		Issuer:    "https://issuer",
+		Audience:  Audience{"a", "b"},
+		ExpiresAt: now.Add(-time.Minute).Unix(),
+	})
+	test.NoError(t, err, "sign failed")
+
+	v := Verifier{Keys: []*Key{key}}
+	_, err = v.Verify(raw, nil)
+	test.SpecificError(t, err, kErrorTokenExpired, "expired token")
+
+	v.Leeway = 2 * time.Minute
+	_, err = v.Verify(raw, nil)
+	test.NoError(t, err, "leeway should cover expiry")
+
+	v.Audience = "c"
+	_, err = v.Verify(raw, nil)
+	test.SpecificError(t, err, kErrorInvalidAudience, "audience mismatch")
+
+	v.Audience = "b"
+	v.Issuer = "https://other"
+	_, err = v.Verify(raw, nil)
+	test.SpecificError(t, err, kErrorInvalidIssuer, "issuer mismatch")
+}
+
+func TestVerifyRejectsAlgorithmSwap(t *testing.T) {
+	keys := testKeys(t)
+	hmacKey, rsaKey := keys[0], keys[1]
+
+	// A token claiming HS256 must not be checked against an RS256 key
+	raw, err := Sign(&Key{ID: rsaKey.ID, Algorithm: HS256, secret: hmacKey.secret}, RegisteredClaims{})
+	test.NoError(t, err, "sign failed")
+
+	v := Verifier{Keys: []*Key{rsaKey.Public()}}
+	_, err = v.Verify(raw, nil)
+	test.SpecificError(t, err, kErrorUnknownKey, "algorithm swap should not find a key")
+}
@@ -0,0 +1,256 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+
+	kES256KeySize = 32
+	kMinHMACSize  = 32
+)
+
+var (
+	kErrorUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+	kErrorKeyAlgorithmMismatch = errors.New("key type does not match algorithm")
+	kErrorNoPrivateKey         = errors.New("key cannot be used for signing")
+	kErrorInvalidSignature     = errors.New("invalid signature")
+	kErrorNoPEMBlock           = errors.New("no PEM block found")
+	kErrorShortSecret          = errors.New("HMAC secret is too short")
+)
+
+/**
+ *
+ * A Key is a single signing / verification key bound to one algorithm. HMAC
+ * keys hold a shared secret; asymmetric keys hold a public key and, when
+ * they are able to sign, the matching private key.
+ *
+ **/
+type Key struct {
+	ID        string
+	Algorithm string
+
+	secret  []byte
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) < kMinHMACSize {
+		return nil, kErrorShortSecret
+	}
+
+	return &Key{ID: id, Algorithm: HS256, secret: secret}, nil
+}
+
+func NewPublicKey(id, alg string, public crypto.PublicKey) (*Key, error) {
+	key := &Key{ID: id, Algorithm: alg, public: public}
+	if err := key.checkType(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func NewPrivateKey(id, alg string, private crypto.Signer) (*Key, error) {
+	key := &Key{ID: id, Algorithm: alg, private: private, public: private.Public()}
+	if err := key.checkType(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// LoadKeyFile reads a PEM encoded private or public key from disk.
+func LoadKeyFile(id, alg, file string) (*Key, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeyPEM(id, alg, data)
+}
+
+// ParseKeyPEM accepts PKCS #8, PKCS #1 and SEC 1 private keys as well as PKIX
+// public keys. Only the first PEM block is used.
+func ParseKeyPEM(id, alg string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, kErrorNoPEMBlock
+	}
+
+	var parsed any
+	var err error
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type (%s)", block.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if signer, ok := parsed.(crypto.Signer); ok {
+		return NewPrivateKey(id, alg, signer)
+	}
+
+	return NewPublicKey(id, alg, parsed)
+}
+
+// Public returns a verification-only copy of an asymmetric key. HMAC keys are
+// returned as-is since the secret is needed to verify.
+func (k *Key) Public() *Key {
+	if k.secret != nil {
+		return k
+	}
+
+	return &Key{ID: k.ID, Algorithm: k.Algorithm, public: k.public}
+}
+
+func (k *Key) PublicKey() crypto.PublicKey {
+	return k.public
+}
+
+func (k *Key) CanSign() bool {
+	return k.secret != nil || k.private != nil
+}
+
+func (k *Key) Sign(data []byte) ([]byte, error) {
+	if !k.CanSign() {
+		return nil, kErrorNoPrivateKey
+	}
+
+	switch k.Algorithm {
+	case HS256:
+		hm := hmac.New(sha256.New, k.secret)
+		hm.Write(data)
+		return hm.Sum(nil), nil
+
+	case RS256:
+		digest := sha256.Sum256(data)
+		return rsa.SignPKCS1v15(rand.Reader, k.private.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+
+	case ES256:
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, k.private.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return nil, err
+		}
+
+		// JWS uses the fixed width R || S encoding rather than ASN.1
+		sig := make([]byte, 2*kES256KeySize)
+		r.FillBytes(sig[:kES256KeySize])
+		s.FillBytes(sig[kES256KeySize:])
+		return sig, nil
+
+	case EdDSA:
+		return ed25519.Sign(k.private.(ed25519.PrivateKey), data), nil
+	}
+
+	return nil, kErrorUnsupportedAlgorithm
+}
+
+func (k *Key) Verify(data, sig []byte) error {
+	valid := false
+
+	switch k.Algorithm {
+	case HS256:
+		hm := hmac.New(sha256.New, k.secret)
+		hm.Write(data)
+		valid = hmac.Equal(hm.Sum(nil), sig)
+
+	case RS256:
+		digest := sha256.Sum256(data)
+		valid = rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+
+	case ES256:
+		if len(sig) == 2*kES256KeySize {
+			digest := sha256.Sum256(data)
+			r := new(big.Int).SetBytes(sig[:kES256KeySize])
+			s := new(big.Int).SetBytes(sig[kES256KeySize:])
+			valid = ecdsa.Verify(k.public.(*ecdsa.PublicKey), digest[:], r, s)
+		}
+
+	case EdDSA:
+		valid = ed25519.Verify(k.public.(ed25519.PublicKey), data, sig)
+
+	default:
+		return kErrorUnsupportedAlgorithm
+	}
+
+	if !valid {
+		return kErrorInvalidSignature
+	}
+
+	return nil
+}
+
+func (k *Key) checkType() error {
+	ok := false
+
+	switch k.Algorithm {
+	case RS256:
+		_, ok = k.public.(*rsa.PublicKey)
+	case ES256:
+		pub, isEC := k.public.(*ecdsa.PublicKey)
+		ok = isEC && pub.Curve == elliptic.P256()
+	case EdDSA:
+		_, ok = k.public.(ed25519.PublicKey)
+	default:
+		return kErrorUnsupportedAlgorithm
+	}
+
+	if !ok {
+		return kErrorKeyAlgorithmMismatch
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kClientAuthNone  = "none"
+	kClientAuthBasic = "client_secret_basic"
+	kClientAuthPost  = "client_secret_post"
+	kClientAuthJWT   = "private_key_jwt"
+
+	// Mutual TLS client authentication (RFC 8705, Section 2)
+	kClientAuthTLS           = "tls_client_auth"
+	kClientAuthSelfSignedTLS = "self_signed_tls_client_auth"
+)
+
+var (
+	// Methods a confidential client can use to authenticate, as advertised
+	// in the discovery document
+	kClientAuthMethods = []string{kClientAuthBasic, kClientAuthPost, kClientAuthJWT, kClientAuthTLS, kClientAuthSelfSignedTLS}
+
+	kMultipleClientAuthError    = errors.New("more than one client authentication method used")
+	kMissingClientIDError       = errors.New("missing client_id")
+	kClientAuthRequiredError    = errors.New("confidential client must authenticate")
+	kWrongClientAuthMethodError = errors.New("client used an authentication method it is not registered for")
+	kClientLockedOutError       = errors.New("client is locked out after too many failed attempts")
+)
+
+// hasClientCredentials reports whether the request tries to authenticate the
+// client, as opposed to a public client that only identifies itself.
+func hasClientCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.PostFormValue("client_secret") != "" || r.PostFormValue("client_assertion") != ""
+}
+
+// authenticateClient checks client_secret_basic or client_secret_post
+// credentials (RFC 6749, Section 2.3.1), a private_key_jwt assertion, or,
+// when nothing else is sent, the client certificate on the connection.
+func authenticateClient(r *http.Request, svcs services.Services) (services.Client, error) {
+	var cid, secret string
+
+	method := kClientAuthPost
+	if r.PostFormValue("client_assertion") != "" || r.PostFormValue("client_assertion_type") != "" {
+		method = kClientAuthJWT
+
+		if r.Header.Get("Authorization") != "" || r.PostFormValue("client_secret") != "" {
+			return services.Client{}, kMultipleClientAuthError
+		}
+
+		cid = assertionClientID(r)
+	} else if r.Header.Get("Authorization") != "" {
+		method = kClientAuthBasic
+
+		if r.PostFormValue("client_secret") != "" {
+			return services.Client{}, kMultipleClientAuthError
+		}
+
+		user, pwd, err := helpers.ParseHttpAuthBasic(r)
+		if err != nil {
+			return services.Client{}, err
+		}
+
+		// Basic credentials are form encoded before being base64 encoded
+		if cid, err = url.QueryUnescape(user); err != nil {
+			return services.Client{}, err
+		}
+		if secret, err = url.QueryUnescape(pwd); err != nil {
+			return services.Client{}, err
+		}
+	} else if r.PostFormValue("client_secret") == "" && clientCertificate(r) != nil {
+		method = kClientAuthTLS
+		cid = r.PostFormValue("client_id")
+	} else {
+		cid = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+
+	if loginLimiterFromContext(r.Context()).locked(r, tokenRequestClientID(r)) {
+		return services.Client{}, kClientLockedOutError
+	}
+
+	var client services.Client
+	var err error
+	switch method {
+	case kClientAuthJWT:
+		client, err = authenticateClientAssertion(r, svcs, cid)
+	case kClientAuthTLS:
+		// Either TLS method; the client's registration decides which
+		client, err = authenticateClientCertificate(r, svcs, cid)
+		method = client.AuthMethod
+	default:
+		client, err = svcs.Authorizer().AuthenticateClient(cid, secret)
+	}
+	if err != nil {
+		return services.Client{}, err
+	}
+
+	if client.AuthMethod != "" && client.AuthMethod != method {
+		return services.Client{}, kWrongClientAuthMethodError
+	}
+
+	return client, nil
+}
+
+// requestClient returns the client a token request is made for. Confidential
+// clients must authenticate; public clients just name themselves.
+func requestClient(r *http.Request, svcs services.Services) (services.Client, error) {
+	if hasClientCredentials(r) {
+		return authenticateClient(r, svcs)
+	}
+
+	cid := r.PostFormValue("client_id")
+	if cid == "" {
+		return services.Client{}, kMissingClientIDError
+	}
+
+	client, err := svcs.Clients().Client(cid)
+	if err != nil {
+		return services.Client{}, err
+	}
+
+	if client.IsConfidential() {
+		// Clients using a TLS certificate send nothing but their client_id
+		if clientCertificate(r) != nil {
+			return authenticateClient(r, svcs)
+		}
+
+		return services.Client{}, kClientAuthRequiredError
+	}
+
+	return client, nil
+}
+
+// requestClientForGrant is requestClient plus the check that the client is
+// registered for the grant type. Errors have been written when ok is false.
+func requestClientForGrant(w http.ResponseWriter, r *http.Request, svcs services.Services, grant string) (services.Client, bool) {
+	client, err := requestClient(r, svcs)
+	if err != nil {
+		log.Printf("[Error] Client authentication failed - %v", err)
+		writeClientAuthError(w, r, err)
+		return services.Client{}, false
+	}
+
+	if !client.AllowsGrant(grant) {
+		log.Printf("[Error] Client (%s) is not registered for the %s grant.", client.ID, grant)
+		writeTokenError(w, http.StatusBadRequest, kUnauthorizedClientError, "grant type not allowed for this client")
+		return services.Client{}, false
+	}
+
+	return client, true
+}
+
+func writeClientAuthError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == kMissingClientIDError {
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, err.Error())
+		return
+	}
+
+	limiter := loginLimiterFromContext(r.Context())
+	if err == kClientLockedOutError {
+		limiter.writeLockedOut(w)
+		return
+	}
+
+	limiter.failed(r, tokenRequestClientID(r))
+
+	// RFC 6749 only requires the 401 / WWW-Authenticate combination when the
+	// client tried the Authorization header.
+	if r.Header.Get("Authorization") != "" {
+		writeTokenError(w, http.StatusUnauthorized, kInvalidClientError, "client authentication failed")
+		return
+	}
+
+	writeTokenError(w, http.StatusBadRequest, kInvalidClientError, "client authentication failed")
+}
@@ -0,0 +1,293 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kClientAssertionTypeJWT = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	kClientKeysContextKey     = "sl.auth.client_keys"
+	kClientAssertionNamespace = "client_assertion"
+
+	// Assertions are meant to be minted per request. Capping their lifetime
+	// also bounds how long a jti has to be remembered.
+	kMaxAssertionLifetime = 1 * time.Hour
+	kAssertionLeeway      = 30 * time.Second
+
+	kJWKSFetchTimeout = 10 * time.Second
+	kMaxJWKSSize      = 1 << 20
+)
+
+var (
+	// The algorithm assumed for a client key that doesn't name one
+	kDefaultJWKAlgorithms = map[string]string{"RSA": jwt.RS256, "EC": jwt.ES256, "OKP": jwt.EdDSA}
+
+	// Assertions have to be signed with a key only the client holds
+	kClientAssertionAlgorithms = []string{jwt.RS256, jwt.ES256, jwt.EdDSA}
+
+	kUnsupportedAssertionTypeError = errors.New("unsupported client_assertion_type")
+	kNoClientKeysError             = errors.New("client has no keys for private_key_jwt")
+	kAssertionSubjectError         = errors.New("client assertion iss and sub must be the client ID")
+	kAssertionAudienceError        = errors.New("client assertion audience does not name this server")
+	kAssertionLifetimeError        = errors.New("client assertion has no expiry or lives too long")
+	kAssertionNoIDError            = errors.New("client assertion has no jti")
+	kAssertionReplayError          = errors.New("client assertion has already been used")
+)
+
+/**
+ *
+ * Keys for private_key_jwt (RFC 7523, Section 2.2). Inline keys come straight
+ * from the config; keys behind a jwks_uri are fetched when first needed and
+ * cached for ClientKeysConfig.CacheTTL.
+ *
+ **/
+
+type clientKeySet struct {
+	config Config
+	client *http.Client
+
+	lock  sync.Mutex
+	cache map[string]cachedClientKeys
+}
+
+type cachedClientKeys struct {
+	keys    []*jwt.Key
+	expires time.Time
+}
+
+func newClientKeySet(config Config) *clientKeySet {
+	return &clientKeySet{
+		config: config,
+		client: &http.Client{Timeout: kJWKSFetchTimeout},
+		cache:  map[string]cachedClientKeys{},
+	}
+}
+
+func clientKeysFromContext(ctx context.Context) *clientKeySet {
+	keys, _ := ctx.Value(kClientKeysContextKey).(*clientKeySet)
+	return keys
+}
+
+// keys returns the verification keys configured for a client.
+func (s *clientKeySet) keys(cid string) ([]*jwt.Key, error) {
+	if s == nil {
+		return nil, kNoClientKeysError
+	}
+
+	source, ok := s.config.ClientKeys.Clients[cid]
+	if !ok {
+		return nil, kNoClientKeysError
+	}
+
+	if source.JWKSURI == "" {
+		return jwksToKeys(source.Keys)
+	}
+
+	s.lock.Lock()
+	cached, ok := s.cache[cid]
+	s.lock.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.keys, nil
+	}
+
+	set, err := s.fetch(source.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := jwksToKeys(set.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	s.cache[cid] = cachedClientKeys{keys: keys, expires: time.Now().Add(s.config.ClientKeys.CacheTTL)}
+	s.lock.Unlock()
+
+	return keys, nil
+}
+
+func (s *clientKeySet) fetch(uri string) (jwt.JWKSet, error) {
+	resp, err := s.client.Get(uri)
+	if err != nil {
+		return jwt.JWKSet{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return jwt.JWKSet{}, fmt.Errorf("fetching client JWKS (%s) failed with status %d", uri, resp.StatusCode)
+	}
+
+	var set jwt.JWKSet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, kMaxJWKSSize)).Decode(&set); err != nil {
+		return jwt.JWKSet{}, err
+	}
+
+	return set, nil
+}
+
+// jwksToKeys keeps the signing keys from a JWK set. Keys without an alg are
+// assumed to use the one algorithm this service supports for their type.
+func jwksToKeys(set []jwt.JWK) ([]*jwt.Key, error) {
+	keys := make([]*jwt.Key, 0, len(set))
+
+	for _, jwk := range set {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		alg := jwk.Algorithm
+		if alg == "" {
+			alg = kDefaultJWKAlgorithms[jwk.KeyType]
+		}
+
+		key, err := jwk.PublicKey(alg)
+		if err != nil {
+			log.Printf("[Error] Skipping unusable client key (%s) - %v", jwk.KeyID, err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, kNoClientKeysError
+	}
+
+	return keys, nil
+}
+
+/**
+ *
+ * Client assertions (RFC 7523, Section 3)
+ *
+ **/
+
+// assertionClientID is the client a private_key_jwt request claims to be,
+// before anything has been verified.
+func assertionClientID(r *http.Request) string {
+	if cid := r.PostFormValue("client_id"); cid != "" {
+		return cid
+	}
+
+	token, err := jwt.Parse(r.PostFormValue("client_assertion"))
+	if err != nil {
+		return ""
+	}
+
+	var claims jwt.RegisteredClaims
+	if err := token.Claims(&claims); err != nil {
+		return ""
+	}
+
+	return claims.Subject
+}
+
+// authenticateClientAssertion checks the client_assertion on a request made
+// by cid and records its jti so it can't be used again.
+func authenticateClientAssertion(r *http.Request, svcs services.Services, cid string) (services.Client, error) {
+	if r.PostFormValue("client_assertion_type") != kClientAssertionTypeJWT {
+		return services.Client{}, kUnsupportedAssertionTypeError
+	}
+
+	if cid == "" {
+		return services.Client{}, kMissingClientIDError
+	}
+
+	client, err := svcs.Clients().Client(cid)
+	if err != nil {
+		return services.Client{}, err
+	}
+
+	set := clientKeysFromContext(r.Context())
+	keys, err := set.keys(cid)
+	if err != nil {
+		return services.Client{}, err
+	}
+
+	verifier := jwt.Verifier{Keys: keys, Issuer: cid, Leeway: kAssertionLeeway}
+
+	var claims jwt.RegisteredClaims
+	if _, err := verifier.Verify(r.PostFormValue("client_assertion"), &claims); err != nil {
+		return services.Client{}, err
+	}
+
+	if claims.Subject != cid {
+		return services.Client{}, kAssertionSubjectError
+	}
+
+	if !assertionAudienceOK(r, set.config, claims.Audience) {
+		return services.Client{}, kAssertionAudienceError
+	}
+
+	expires := time.Unix(claims.ExpiresAt, 0)
+	if claims.ExpiresAt == 0 || time.Until(expires) > kMaxAssertionLifetime {
+		return services.Client{}, kAssertionLifetimeError
+	}
+
+	if claims.ID == "" {
+		return services.Client{}, kAssertionNoIDError
+	}
+
+	kvs := svcs.Ephemeral().KeyValues()
+	if err := kvs.CheckAndSet(kClientAssertionNamespace, cid+":"+claims.ID, true, time.Until(expires)+kAssertionLeeway); err != nil {
+		return services.Client{}, kAssertionReplayError
+	}
+
+	return client, nil
+}
+
+// assertionAudienceOK accepts the issuer, the token endpoint or the endpoint
+// the assertion was actually sent to.
+func assertionAudienceOK(r *http.Request, config Config, aud jwt.Audience) bool {
+	accepted := []string{
+		requestBase(r, config) + kTokenRoute,
+		requestOrigin(r, config) + r.URL.Path,
+	}
+	if config.Issuer != "" {
+		accepted = append(accepted, config.Issuer)
+	}
+
+	for _, a := range accepted {
+		if aud.Contains(a) {
+			return true
+		}
+	}
+
+	return false
+}
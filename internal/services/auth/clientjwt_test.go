@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestClientAssertion(t *testing.T) {
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.NoError(t, err, "generating client key")
+	key, err := jwt.NewPrivateKey("partner-1", jwt.ES256, ek)
+	test.NoError(t, err, "wrapping client key")
+	jwk, err := key.JWK()
+	test.NoError(t, err, "exporting client key")
+
+	config := DefaultConfig()
+	config.Path = "/auth"
+	config.Issuer = "https://issuer.example"
+	config.ClientKeys.Clients["partner"] = ClientKeySource{Keys: []jwt.JWK{jwk}}
+
+	kvs := services.NewMemoryStore(context.Background())
+	svcs := &services.ServicesContainer{
+		EphemeralStore: &services.SimpleDataStore{KVS: kvs},
+		Registry:       services.NewClientRegistry([]services.Client{{ID: "partner", Type: services.ClientTypeConfidential}}, kvs),
+	}
+	keys := newClientKeySet(config)
+
+	authenticate := func(jti, aud string) error {
+		assertion, err := jwt.Sign(key, jwt.RegisteredClaims{
+			Issuer:    "partner",
+			Subject:   "partner",
+			Audience:  jwt.Audience{aud},
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			ID:        jti,
+		})
+		test.NoError(t, err, "signing assertion")
+
+		form := url.Values{"client_assertion_type": {kClientAssertionTypeJWT}, "client_assertion": {assertion}}
+		r := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), kClientKeysContextKey, keys))
+
+		_, err = authenticateClient(r, svcs)
+		return err
+	}
+
+	test.NoError(t, authenticate("one", "https://issuer.example/auth/token"), "token endpoint audience")
+	test.SpecificError(t, authenticate("one", "https://issuer.example/auth/token"), kAssertionReplayError, "jti is single use")
+	test.NoError(t, authenticate("two", "https://issuer.example"), "issuer audience")
+	test.SpecificError(t, authenticate("three", "https://elsewhere.example"), kAssertionAudienceError, "foreign audience")
+}
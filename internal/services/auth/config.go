@@ -24,44 +24,318 @@ package auth
 
 import (
 	"time"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
 )
 
 const (
-	kDefaultQRCodeTTL = 2 * time.Minute
-	kDefaultCodeTTL   = 1 * time.Minute
-	kDefaultTokenTTL  = 30 * time.Minute
+	kDefaultQRCodeTTL    = 2 * time.Minute
+	kDefaultQRRequestTTL = 10 * time.Minute
+	kDefaultCodeTTL      = 1 * time.Minute
+	kDefaultTokenTTL     = 30 * time.Minute
+
+	kDefaultRefreshTTL       = 7 * 24 * time.Hour
+	kDefaultRefreshFamilyTTL = 30 * 24 * time.Hour
+
+	kDefaultDeviceCodeTTL      = 10 * time.Minute
+	kDefaultDevicePollInterval = 5 * time.Second
+
+	kDefaultPARTTL = 1 * time.Minute
+
+	kDefaultDPoPProofWindow = 5 * time.Minute
+	kDefaultDPoPNonceTTL    = 5 * time.Minute
+
+	kDefaultClientKeysCacheTTL = 1 * time.Hour
+
+	kDefaultSigningAlgorithm = "HS256"
+
+	kDefaultTOTPIssuer    = "Shifty Logic"
+	kDefaultTOTPSkew      = 1
+	kDefaultRecoveryCodes = 10
+
+	kDefaultSessionCookie  = "sl_session"
+	kDefaultSessionIdleTTL = 1 * time.Hour
+	kDefaultSessionMaxTTL  = 24 * time.Hour
+
+	kDefaultLockoutWindow       = 15 * time.Minute
+	kDefaultLockoutAccountLimit = 10
+	kDefaultLockoutIPLimit      = 50
+	kDefaultLockoutDelayAfter   = 3
+	kDefaultLockoutBaseDelay    = 500 * time.Millisecond
+	kDefaultLockoutMaxDelay     = 8 * time.Second
 )
 
 type Config struct {
 	Path      string `json:"path" yaml:"Path"`
+	Issuer    string `json:"issuer" yaml:"Issuer"`
 	Secret    string `json:"secret" yaml:"Secret"`
 	Templates string `json:"templates" yaml:"Templates"`
 
 	CodeTTL  time.Duration `json:"codeTTL" yaml:"CodeTTL"`
 	TokenTTL time.Duration `json:"tokenTTL" yaml:"tokenTTL"`
 
-	QRScan QRScanConfig `json:"qrscan" yaml:"QRScan"`
+	// Refresh tokens rotate on every use. RefreshTTL bounds how long a single
+	// token stays usable, RefreshFamilyTTL bounds the whole rotation chain.
+	RefreshTTL       time.Duration `json:"refreshTTL" yaml:"RefreshTTL"`
+	RefreshFamilyTTL time.Duration `json:"refreshFamilyTTL" yaml:"RefreshFamilyTTL"`
+
+	Signing SigningConfig `json:"signing" yaml:"Signing"`
+	Device  DeviceConfig  `json:"device" yaml:"Device"`
+	PAR     PARConfig     `json:"par" yaml:"PAR"`
+	DPoP    DPoPConfig    `json:"dpop" yaml:"DPoP"`
+	QRScan  QRScanConfig  `json:"qrscan" yaml:"QRScan"`
+
+	Registration RegistrationConfig `json:"registration" yaml:"Registration"`
+	TOTP         TOTPConfig         `json:"totp" yaml:"TOTP"`
+	Lockout      LockoutConfig      `json:"lockout" yaml:"Lockout"`
+	Session      SessionConfig      `json:"session" yaml:"Session"`
+	ClientKeys   ClientKeysConfig   `json:"clientKeys" yaml:"ClientKeys"`
+
+	// Certificates each tls_client_auth client must present, by client ID.
+	// self_signed_tls_client_auth clients are matched against ClientKeys.
+	ClientCerts map[string]ClientCertConfig `json:"clientCerts" yaml:"ClientCerts"`
+
+	// What each client may do with the token exchange grant, by client ID.
+	// Clients without a policy can't exchange tokens.
+	TokenExchange map[string]TokenExchangePolicy `json:"tokenExchange" yaml:"TokenExchange"`
+
+	// Scope registry: the description shown on the consent screen for every
+	// scope a client may ask for
+	Scopes map[string]string `json:"scopes" yaml:"Scopes"`
+}
+
+type SigningConfig struct {
+	KeyConfig `yaml:",inline"`
+
+	// Keys that are published and trusted for verification but never used
+	// for signing, e.g. the previous key during a rotation
+	Rotated []KeyConfig `json:"rotated" yaml:"Rotated"`
+}
+
+// servesOpenID reports whether ID tokens can be issued. Under HS256 they would
+// be MACed with Config.Secret, which no client can verify without being able
+// to forge them, so openid is only served with an asymmetric signing key.
+func (c Config) servesOpenID() bool {
+	return c.Signing.Algorithm != jwt.HS256
+}
+
+type KeyConfig struct {
+	// One of HS256 (keyed by Config.Secret), RS256, ES256 or EdDSA
+	Algorithm string `json:"algorithm" yaml:"Algorithm"`
+	// PEM encoded private key used by the asymmetric algorithms
+	KeyFile string `json:"keyFile" yaml:"KeyFile"`
+	// Published 'kid'; defaults to the key's RFC 7638 thumbprint
+	KeyID string `json:"keyID" yaml:"KeyID"`
+}
+
+// Device authorization grant (RFC 8628)
+type DeviceConfig struct {
+	// How long the device and user codes are good for
+	TTL time.Duration `json:"ttl" yaml:"TTL"`
+	// Minimum time between token requests from the polling device
+	Interval time.Duration `json:"interval" yaml:"Interval"`
+}
+
+// Pushed authorization requests (RFC 9126)
+type PARConfig struct {
+	// How long a request_uri is good for; it only has to outlive the redirect
+	// to the authorization endpoint
+	TTL time.Duration `json:"ttl" yaml:"TTL"`
+}
+
+// Sender-constrained tokens (RFC 9449)
+type DPoPConfig struct {
+	// How far a proof's iat may be from the server's clock, either way
+	ProofWindow time.Duration `json:"proofWindow" yaml:"ProofWindow"`
+	// Make every proof carry a nonce handed out in a DPoP-Nonce header
+	RequireNonce bool          `json:"requireNonce" yaml:"RequireNonce"`
+	NonceTTL     time.Duration `json:"nonceTTL" yaml:"NonceTTL"`
+}
+
+// private_key_jwt client authentication (RFC 7523)
+type ClientKeysConfig struct {
+	// Keys each client signs its assertions with, by client ID
+	Clients map[string]ClientKeySource `json:"clients" yaml:"Clients"`
+	// How long keys fetched from a client's jwks_uri are used before they are
+	// fetched again
+	CacheTTL time.Duration `json:"cacheTTL" yaml:"CacheTTL"`
+}
+
+// Either inline public keys or a URL serving the client's JWK set
+type ClientKeySource struct {
+	Keys    []jwt.JWK `json:"keys" yaml:"Keys"`
+	JWKSURI string    `json:"jwksURI" yaml:"JWKSURI"`
+}
+
+// tls_client_auth client authentication (RFC 8705, Section 2.1.2). The
+// certificate must chain to the listener's client CAs and carry the subject
+// DN (as formatted by RFC 4514) or the one SAN entry given here.
+type ClientCertConfig struct {
+	SubjectDN string `json:"subjectDN" yaml:"SubjectDN"`
+	SANDNS    string `json:"sanDNS" yaml:"SANDNS"`
+	SANURI    string `json:"sanURI" yaml:"SANURI"`
+	SANIP     string `json:"sanIP" yaml:"SANIP"`
+	SANEmail  string `json:"sanEmail" yaml:"SANEmail"`
+}
+
+// Token exchange (RFC 8693)
+type TokenExchangePolicy struct {
+	// Audiences and resource URIs the client may ask exchanged tokens for
+	Audiences []string `json:"audiences" yaml:"Audiences"`
+	// Clients whose tokens the client may exchange, besides its own
+	SubjectClients []string `json:"subjectClients" yaml:"SubjectClients"`
+	// Allow delegation, where the client's own access token is sent as the
+	// actor_token and recorded in the act claim of the new token
+	Delegation bool `json:"delegation" yaml:"Delegation"`
+}
+
+// Dynamic client registration (RFC 7591 / 7592)
+type RegistrationConfig struct {
+	Enabled bool `json:"enabled" yaml:"Enabled"`
+	// Bearer tokens that allow registering a new client. Registration is
+	// refused outright when none are configured.
+	InitialAccessTokens []string `json:"initialAccessTokens" yaml:"InitialAccessTokens"`
+	// Scopes given to clients that register without asking for any. Clients
+	// can only ask for scopes listed in Config.Scopes.
+	DefaultScopes []string `json:"defaultScopes" yaml:"DefaultScopes"`
+}
+
+// TOTP second factor (RFC 6238)
+type TOTPConfig struct {
+	// Label shown next to the account in authenticator apps
+	Issuer string `json:"issuer" yaml:"Issuer"`
+	// Number of 30 second steps either side of now that are still accepted
+	Skew int `json:"skew" yaml:"Skew"`
+	// Recovery codes handed out on enrollment
+	RecoveryCodes int `json:"recoveryCodes" yaml:"RecoveryCodes"`
+}
+
+// Browser sign-in session shared by every client
+type SessionConfig struct {
+	Enabled    bool   `json:"enabled" yaml:"Enabled"`
+	CookieName string `json:"cookieName" yaml:"CookieName"`
+	// A session ends after IdleTTL without use or MaxTTL after sign-in,
+	// whichever comes first
+	IdleTTL time.Duration `json:"idleTTL" yaml:"IdleTTL"`
+	MaxTTL  time.Duration `json:"maxTTL" yaml:"MaxTTL"`
+}
+
+// Brute-force protection for the login and token endpoints
+type LockoutConfig struct {
+	Enabled bool `json:"enabled" yaml:"Enabled"`
+	// Failures are counted over a sliding window of this length; a lockout
+	// lifts on its own once the count decays below the limit
+	Window time.Duration `json:"window" yaml:"Window"`
+	// Failures allowed per account (or client) and per remote address
+	AccountLimit uint `json:"accountLimit" yaml:"AccountLimit"`
+	IPLimit      uint `json:"ipLimit" yaml:"IPLimit"`
+	// Failures before responses are slowed down, starting at BaseDelay and
+	// doubling up to MaxDelay
+	DelayAfter uint          `json:"delayAfter" yaml:"DelayAfter"`
+	BaseDelay  time.Duration `json:"baseDelay" yaml:"BaseDelay"`
+	MaxDelay   time.Duration `json:"maxDelay" yaml:"MaxDelay"`
 }
 
 type QRScanConfig struct {
-	Enabled bool          `json:"enabled" yaml:"Enabled"`
-	Prefix  string        `json:"prefix" yaml:"Prefix"`
-	TTL     time.Duration `json:"ttl" yaml:"TTL"`
+	Enabled bool `json:"enabled" yaml:"Enabled"`
+	// URL encoded in the QR code; defaults to the scan endpoint under Issuer
+	Prefix string `json:"prefix" yaml:"Prefix"`
+	// How long a single QR code is good for
+	TTL time.Duration `json:"ttl" yaml:"TTL"`
+	// How long the login page waits for a scan before starting over
+	RequestTTL time.Duration `json:"requestTTL" yaml:"RequestTTL"`
+	// First-party clients (e.g. the mobile app) whose tokens may approve a
+	// scanned code. Approving signs the user in to another client, so no
+	// other client's token is accepted, whatever its scopes.
+	ApproverClients []string `json:"approverClients" yaml:"ApproverClients"`
 }
 
 func DefaultConfig() Config {
 	return Config{
 		Path:      "",
+		Issuer:    "",
 		Secret:    "",
 		Templates: "",
 
 		CodeTTL:  kDefaultCodeTTL,
 		TokenTTL: kDefaultTokenTTL,
 
+		RefreshTTL:       kDefaultRefreshTTL,
+		RefreshFamilyTTL: kDefaultRefreshFamilyTTL,
+
+		Signing: SigningConfig{
+			KeyConfig: KeyConfig{
+				Algorithm: kDefaultSigningAlgorithm,
+				KeyFile:   "",
+				KeyID:     "",
+			},
+			Rotated: []KeyConfig{},
+		},
+
+		Device: DeviceConfig{
+			TTL:      kDefaultDeviceCodeTTL,
+			Interval: kDefaultDevicePollInterval,
+		},
+
+		PAR: PARConfig{
+			TTL: kDefaultPARTTL,
+		},
+
+		DPoP: DPoPConfig{
+			ProofWindow:  kDefaultDPoPProofWindow,
+			RequireNonce: false,
+			NonceTTL:     kDefaultDPoPNonceTTL,
+		},
+
+		ClientKeys: ClientKeysConfig{
+			Clients:  map[string]ClientKeySource{},
+			CacheTTL: kDefaultClientKeysCacheTTL,
+		},
+
+		Registration: RegistrationConfig{
+			Enabled:             false,
+			InitialAccessTokens: []string{},
+			DefaultScopes:       []string{kScopeOpenID},
+		},
+
+		TOTP: TOTPConfig{
+			Issuer:        kDefaultTOTPIssuer,
+			Skew:          kDefaultTOTPSkew,
+			RecoveryCodes: kDefaultRecoveryCodes,
+		},
+
+		Session: SessionConfig{
+			Enabled:    true,
+			CookieName: kDefaultSessionCookie,
+			IdleTTL:    kDefaultSessionIdleTTL,
+			MaxTTL:     kDefaultSessionMaxTTL,
+		},
+
+		Lockout: LockoutConfig{
+			Enabled:      true,
+			Window:       kDefaultLockoutWindow,
+			AccountLimit: kDefaultLockoutAccountLimit,
+			IPLimit:      kDefaultLockoutIPLimit,
+			DelayAfter:   kDefaultLockoutDelayAfter,
+			BaseDelay:    kDefaultLockoutBaseDelay,
+			MaxDelay:     kDefaultLockoutMaxDelay,
+		},
+
+		Scopes: map[string]string{
+			"openid":  "Sign you in with your account",
+			"profile": "See your name and basic profile information",
+			"email":   "See your email address",
+			"address": "See your postal address",
+			"phone":   "See your phone number",
+		},
+
 		QRScan: QRScanConfig{
-			Enabled: false,
-			Prefix:  "",
-			TTL:     kDefaultQRCodeTTL,
+			Enabled:    false,
+			Prefix:     "",
+			TTL:        kDefaultQRCodeTTL,
+			RequestTTL: kDefaultQRRequestTTL,
+
+			ApproverClients: []string{},
 		},
 	}
 }
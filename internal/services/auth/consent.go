@@ -0,0 +1,232 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/web"
+)
+
+const (
+	kConsentRoute    = "/consent"
+	kConsentTemplate = "consent.html"
+
+	kConsentRequestIDSize = 20
+	kConsentPendingTTL    = 10 * time.Minute
+
+	// Remembered decisions live until the user changes them; pending ones
+	// only as long as the consent page may reasonably stay open
+	kConsentNamespace        = "consent"
+	kConsentPendingNamespace = "consent_pending"
+
+	// OpenID Connect 'prompt' values (Core, Section 3.1.2.1)
+	kPromptNone    = "none"
+	kPromptConsent = "consent"
+
+	kConsentRequiredError = "consent_required"
+)
+
+// The scopes a user has agreed to let a client use
+type consentRecord struct {
+	Scopes  []string
+	Updated time.Time
+}
+
+type consentScope struct {
+	Name        string
+	Description string
+}
+
+type consentViewData struct {
+	RequestID  string
+	ClientName string
+	ClientLogo string
+	Scopes     []consentScope
+	CSRFField  template.HTML
+}
+
+// completeAuthorization is the last step of every authorization request. The code
+// is issued right away when the user already agreed to everything the client
+// asks for; otherwise the browser is sent to the consent page.
+func completeAuthorization(w http.ResponseWriter, r *http.Request, config Config, svcs services.Services, data services.AuthCodeData) {
+	kvs := svcs.Ephemeral().KeyValues()
+
+	if !needsConsent(kvs, data) {
+		issueAuthorizationCode(w, r, config, svcs, data)
+		return
+	}
+
+	if hasScope(data.Prompt, kPromptNone) {
+		redirectAuthError(w, r, config, data, kConsentRequiredError, "user consent is required")
+		return
+	}
+
+	rid, err := storeWithRandomKey(kvs, kConsentPendingNamespace, kConsentRequestIDSize, data, kConsentPendingTTL)
+	if err != nil {
+		log.Printf("[Error] Failed to start consent request - %v", err)
+		redirectAuthError(w, r, config, data, kServerError, "")
+		return
+	}
+
+	trackPending(kvs, data.UID, kConsentPendingNamespace, rid, kConsentPendingTTL)
+	http.Redirect(w, r, strings.TrimSuffix(config.Path, "/")+kConsentRoute+"?rid="+rid, http.StatusSeeOther)
+}
+
+func issueAuthorizationCode(w http.ResponseWriter, r *http.Request, config Config, svcs services.Services, data services.AuthCodeData) {
+	kvs := svcs.Ephemeral().KeyValues()
+
+	code, err := svcs.Authorizer().GenerateAuthorizationRequest(data, config.CodeTTL)
+	if err != nil {
+		log.Printf("[Error] Failed to generate authorization code - %v", err)
+		redirectAuthError(w, r, config, data, kServerError, "")
+		return
+	}
+
+	trackPending(kvs, data.UID, services.AuthCodeNamespace, code, config.CodeTTL)
+
+	redirectAuthSuccess(w, r, config, data, code)
+}
+
+// Consent shows the scopes a client asks for and records the user's answer.
+func Consent(templates *template.Template, config Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		rid := r.FormValue("rid")
+
+		if r.Method == http.MethodGet {
+			value, err := kvs.Read(kConsentPendingNamespace, rid)
+			data, ok := value.(services.AuthCodeData)
+			if err != nil || !ok {
+				log.Print("[Error] Unknown consent request.")
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+
+			view := consentViewData{
+				RequestID: rid,
+				Scopes:    describeScopes(config, data.Scope),
+				CSRFField: web.CSRFTemplateField(r),
+			}
+			if client, err := svcs.Clients().Client(data.ClientID); err == nil {
+				view.ClientName = client.Name
+				view.ClientLogo = client.LogoURI
+			}
+			if view.ClientName == "" {
+				view.ClientName = data.ClientID
+			}
+
+			if err := templates.ExecuteTemplate(w, kConsentTemplate, view); err != nil {
+				log.Printf("[Error] Failed to execute 'consent' template - %v", err)
+			}
+			return
+		}
+
+		// Answering spends the request, whatever the answer was
+		value, err := kvs.ReadAndRemove(kConsentPendingNamespace, rid)
+		data, ok := value.(services.AuthCodeData)
+		if err != nil || !ok {
+			log.Print("[Error] Unknown or already answered consent request.")
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if r.PostFormValue("action") != kActionApprove {
+			log.Printf("[Error] User (%s) denied consent for client (%s).", data.UID, data.ClientID)
+			redirectAuthError(w, r, config, data, kAccessDeniedError, "the user denied the request")
+			return
+		}
+
+		if err := rememberConsent(kvs, data); err != nil {
+			// Not fatal; the user will just be asked again next time
+			log.Printf("[Error] Failed to save consent - %v", err)
+		}
+
+		issueAuthorizationCode(w, r, config, svcs, data)
+	}
+}
+
+// needsConsent reports whether the user has to be asked: on first use of a
+// client, when new scopes are requested and whenever prompt=consent is sent.
+func needsConsent(kvs services.KeyValueStore, data services.AuthCodeData) bool {
+	if hasScope(data.Prompt, kPromptConsent) {
+		return true
+	}
+
+	value, err := kvs.Read(kConsentNamespace, consentKey(data.UID, data.ClientID))
+	if err != nil {
+		return true
+	}
+
+	record, ok := value.(consentRecord)
+	return !ok || !scopeSubset(data.Scope, strings.Join(record.Scopes, " "))
+}
+
+// rememberConsent adds the request's scopes to what the user already granted
+// the client. Scopes are never dropped here; a later, narrower request must
+// not take away what an earlier one was given.
+func rememberConsent(kvs services.KeyValueStore, data services.AuthCodeData) error {
+	key := consentKey(data.UID, data.ClientID)
+
+	var scopes []string
+	if value, err := kvs.Read(kConsentNamespace, key); err == nil {
+		if record, ok := value.(consentRecord); ok {
+			scopes = record.Scopes
+		}
+	}
+
+	granted := strings.Join(scopes, " ")
+	for _, scope := range strings.Fields(data.Scope) {
+		if !hasScope(granted, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	return kvs.Set(kConsentNamespace, key, consentRecord{Scopes: scopes, Updated: time.Now()}, services.NoExpiration)
+}
+
+func consentKey(uid, cid string) string {
+	return uid + "|" + cid
+}
+
+// describeScopes pairs each requested scope with its description from the
+// scope registry. Unregistered scopes are shown by name.
+func describeScopes(config Config, scope string) []consentScope {
+	scopes := make([]consentScope, 0)
+	for _, name := range strings.Fields(scope) {
+		desc, ok := config.Scopes[name]
+		if !ok || desc == "" {
+			desc = name
+		}
+
+		scopes = append(scopes, consentScope{Name: name, Description: desc})
+	}
+
+	return scopes
+}
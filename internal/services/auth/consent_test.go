@@ -0,0 +1,55 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestRememberedConsent(t *testing.T) {
+	kvs := services.NewMemoryStore(context.Background())
+	data := services.AuthCodeData{UID: "1", ClientID: "cid", Scope: "openid email"}
+
+	test.Require(t, needsConsent(kvs, data), "first use asks")
+	test.NoError(t, rememberConsent(kvs, data), "remembering consent")
+	test.Require(t, !needsConsent(kvs, data), "same scopes are remembered")
+
+	data.Scope = "openid"
+	test.Require(t, !needsConsent(kvs, data), "fewer scopes are covered")
+	test.NoError(t, rememberConsent(kvs, data), "remembering narrower consent")
+
+	data.Scope = "email phone"
+	test.Require(t, needsConsent(kvs, data), "new scopes ask again")
+
+	data.Scope = "email"
+	data.Prompt = "consent"
+	test.Require(t, needsConsent(kvs, data), "prompt=consent always asks")
+
+	data.Prompt = ""
+	data.ClientID = "other"
+	test.Require(t, needsConsent(kvs, data), "consent is per client")
+}
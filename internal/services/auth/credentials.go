@@ -0,0 +1,87 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kGrantClientCredentials = "client_credentials"
+)
+
+func tokenFromClientCredentials(w http.ResponseWriter, r *http.Request, config Config, minter *TokenMinter) {
+	svcs := services.ServicesFromContext(r.Context())
+
+	client, err := authenticateClient(r, svcs)
+	if err != nil {
+		log.Printf("[Error] Client authentication failed - %v", err)
+		writeClientAuthError(w, r, err)
+		return
+	}
+
+	if !client.AllowsGrant(kGrantClientCredentials) {
+		log.Printf("[Error] Client (%s) is not registered for the %s grant.", client.ID, kGrantClientCredentials)
+		writeTokenError(w, http.StatusBadRequest, kUnauthorizedClientError, "grant type not allowed for this client")
+		return
+	}
+
+	allowed := strings.Join(client.Scopes, " ")
+
+	scope := r.PostFormValue("scope")
+	if scope == "" {
+		scope = allowed
+	} else if !scopeSubset(scope, allowed) {
+		log.Printf("[Error] Client (%s) requested scopes beyond its allowance.", client.ID)
+		writeTokenError(w, http.StatusBadRequest, kInvalidScopeError, "requested scope is not allowed for this client")
+		return
+	}
+
+	// There is no user for this grant, so the client is its own subject. No
+	// refresh token is issued since the client can always authenticate again.
+	grant := services.AuthCodeData{
+		UID:      client.ID,
+		ClientID: client.ID,
+		Scope:    scope,
+		JKT:      dpopKeyFromContext(r.Context()),
+		X5T:      clientCertThumbprint(r),
+	}
+
+	token, _, err := minter.Issue(svcs.Ephemeral().KeyValues(), grant, "")
+	if err != nil {
+		log.Printf("[Error] Failed to issue access token - %v", err)
+		writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		return
+	}
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken: token,
+		TokenType:   tokenType(grant.JKT),
+		ExpiresIn:   int64(config.TokenTTL.Seconds()),
+		Scope:       scope,
+	})
+}
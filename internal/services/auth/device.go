@@ -0,0 +1,523 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/web"
+)
+
+const (
+	kGrantDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+	kDeviceAuthorizationRoute = "/device_authorization"
+	kDeviceRoute              = "/device"
+
+	kDeviceCodeSize = 32
+	kUserCodeSize   = 8
+	// No vowels, so user codes never spell words, and nothing easily confused
+	kUserCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+
+	kDeviceCodeNamespace = "device_code"
+	kUserCodeNamespace   = "user_code"
+	kDeviceMFANamespace  = "device_mfa"
+
+	// RFC 8628 (Section 3.5) polling errors
+	kAuthorizationPendingError = "authorization_pending"
+	kSlowDownError             = "slow_down"
+	kExpiredTokenError         = "expired_token"
+
+	kSlowDownIncrement = 5 * time.Second
+
+	// How long an expired device code is remembered, so late polls are told
+	// expired_token rather than being mistaken for a code never issued
+	kExpiredDeviceCodeTTL = 10 * time.Minute
+)
+
+var (
+	kUnknownUserCodeError = errors.New("unknown or expired user code")
+	kDeviceAnsweredError  = errors.New("device request already answered")
+	kDeviceStateError     = errors.New("unexpected value stored for device code")
+)
+
+// The state behind a device_code while the user finds a browser. Grant picks
+// up the user once they approve.
+type deviceRequest struct {
+	Grant    services.AuthCodeData
+	UserCode string
+	Status   string
+	Interval time.Duration
+	LastPoll time.Time
+	Expires  time.Time
+}
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval,omitempty"`
+}
+
+// An approval that passed the password check and waits for the second factor
+type deviceMFAPending struct {
+	DeviceCode string
+	UID        string
+	Attempts   int
+	Expires    time.Time
+}
+
+// ClientName is only set once a valid user code is known; until then the page
+// just asks for the code. RequestID is set while a second factor is needed.
+type deviceViewData struct {
+	UserCode   string
+	RequestID  string
+	ClientName string
+	ClientLogo string
+	Scopes     []consentScope
+	Message    string
+	Error      string
+	Done       bool
+	CSRFField  template.HTML
+}
+
+// DeviceAuthorization starts a device flow (RFC 8628, Section 3.1) for a
+// client that can't handle a browser redirect itself.
+func DeviceAuthorization(config Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+
+		client, ok := requestClientForGrant(w, r, svcs, kGrantDeviceCode)
+		if !ok {
+			return
+		}
+
+		scope := r.PostFormValue("scope")
+		if !client.AllowsScope(scope) {
+			log.Printf("[Error] Client (%s) requested scopes beyond its allowance.", client.ID)
+			writeTokenError(w, http.StatusBadRequest, kInvalidScopeError, "requested scope is not allowed for this client")
+			return
+		}
+
+		req := deviceRequest{
+			Grant: services.AuthCodeData{
+				ClientID: client.ID,
+				Scope:    scope,
+			},
+			Status:   kStatusPending,
+			Interval: config.Device.Interval,
+			Expires:  time.Now().Add(config.Device.TTL),
+		}
+
+		// The user code is what people type, so it is short; the device code is
+		// what the client polls with and has to be unguessable.
+		var err error
+		req.UserCode, err = storeWithRandomCode(kvs, kUserCodeNamespace, kUserCodeSize, kUserCodeChars, "", config.Device.TTL)
+		if err != nil {
+			log.Printf("[Error] Failed to generate user code - %v", err)
+			writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+			return
+		}
+
+		deviceCode, err := storeWithRandomKey(kvs, kDeviceCodeNamespace, kDeviceCodeSize, req, deviceRequestTTL(req))
+		if err != nil {
+			log.Printf("[Error] Failed to generate device code - %v", err)
+			kvs.Remove(kUserCodeNamespace, req.UserCode)
+			writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+			return
+		}
+
+		if err := kvs.Set(kUserCodeNamespace, req.UserCode, deviceCode, config.Device.TTL); err != nil {
+			log.Printf("[Error] Failed to link user code - %v", err)
+			writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+			return
+		}
+
+		uri := requestBase(r, config) + kDeviceRoute
+		writeJSON(w, http.StatusOK, deviceAuthorizationResponse{
+			DeviceCode:              deviceCode,
+			UserCode:                formatUserCode(req.UserCode),
+			VerificationURI:         uri,
+			VerificationURIComplete: uri + "?user_code=" + formatUserCode(req.UserCode),
+			ExpiresIn:               int64(config.Device.TTL.Seconds()),
+			Interval:                int64(req.Interval.Seconds()),
+		})
+	}
+}
+
+// DeviceVerification is the page users visit to enter a user code, sign in
+// and approve (or deny) the device. Like the consent page, it shows which
+// client is asking and for what before anyone signs in. Users with an
+// authenticator have to give a code from it before an approval counts.
+func DeviceVerification(templates *template.Template, config Config) func(w http.ResponseWriter, r *http.Request) {
+	render := func(w http.ResponseWriter, r *http.Request, status int, data deviceViewData) {
+		data.CSRFField = web.CSRFTemplateField(r)
+		w.WriteHeader(status)
+		if err := templates.ExecuteTemplate(w, kDeviceTemplate, data); err != nil {
+			log.Printf("[Error] Failed to execute 'device' template - %v", err)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		view := deviceViewData{UserCode: r.FormValue("user_code")}
+
+		if r.Method == http.MethodGet && view.UserCode == "" {
+			render(w, r, http.StatusOK, view)
+			return
+		}
+
+		if rid := r.PostFormValue("rid"); rid != "" {
+			deviceSecondFactor(w, r, svcs, kvs, config, rid, render)
+			return
+		}
+
+		limiter := loginLimiterFromContext(r.Context())
+		if limiter.locked(r, r.PostFormValue("user")) {
+			view.Error = "Too many failed attempts, try again later."
+			render(w, r, http.StatusTooManyRequests, view)
+			return
+		}
+
+		deviceCode, req, err := readDeviceRequestByUserCode(kvs, normalizeUserCode(view.UserCode))
+		if err != nil {
+			log.Printf("[Error] Device verification failed - %v", err)
+			// User codes are short, so guessing them counts against the address
+			limiter.failed(r, "")
+			view.Error = "That code is invalid or has expired."
+			render(w, r, http.StatusBadRequest, view)
+			return
+		}
+
+		describeDeviceRequest(&view, config, svcs, req)
+		if r.Method == http.MethodGet {
+			render(w, r, http.StatusOK, view)
+			return
+		}
+
+		uid, err := svcs.Authorizer().Authenticate(r.PostFormValue("user"), r.PostFormValue("pwd"))
+		if err != nil {
+			log.Printf("[Error] Authentication failed - %v", err)
+			limiter.failed(r, r.PostFormValue("user"))
+			view.Error = "Invalid username or password."
+			render(w, r, http.StatusUnauthorized, view)
+			return
+		}
+
+		approve := r.PostFormValue("action") == kActionApprove
+		if approve {
+			user, err := svcs.Users().User(uid)
+			if err != nil {
+				log.Printf("[Error] Failed to load user (%s) - %v", uid, err)
+				view.Error = http.StatusText(http.StatusInternalServerError)
+				render(w, r, http.StatusInternalServerError, view)
+				return
+			}
+
+			if user.HasTOTP() {
+				pending := deviceMFAPending{DeviceCode: deviceCode, UID: uid, Expires: time.Now().Add(kMFAPendingTTL)}
+				if view.RequestID, err = storeWithRandomKey(kvs, kDeviceMFANamespace, kMFARequestIDSize, pending, kMFAPendingTTL); err != nil {
+					log.Printf("[Error] Failed to start second factor - %v", err)
+					view.Error = http.StatusText(http.StatusInternalServerError)
+					render(w, r, http.StatusInternalServerError, view)
+					return
+				}
+
+				render(w, r, http.StatusOK, view)
+				return
+			}
+		}
+
+		answerDeviceRequest(w, r, kvs, view, deviceCode, req, uid, approve, []string{kAMRPassword}, render)
+	}
+}
+
+// deviceSecondFactor checks the authenticator (or recovery) code for an
+// approval parked by DeviceVerification, then records the approval. Like
+// SecondFactor, an attempt takes the parked approval out of the store while
+// the code is checked.
+func deviceSecondFactor(w http.ResponseWriter, r *http.Request, svcs services.Services, kvs services.KeyValueStore, config Config, rid string, render func(http.ResponseWriter, *http.Request, int, deviceViewData)) {
+	var view deviceViewData
+
+	value, err := kvs.ReadAndRemove(kDeviceMFANamespace, rid)
+	pending, ok := value.(deviceMFAPending)
+	if err != nil || !ok {
+		log.Print("[Error] Unknown device second factor request.")
+		view.Error = "That sign in has expired, please start again."
+		render(w, r, http.StatusBadRequest, view)
+		return
+	}
+
+	req, err := readDeviceRequest(kvs, pending.DeviceCode)
+	if err != nil || req.Status != kStatusPending || time.Now().After(req.Expires) {
+		view.Error = "That code is invalid or has expired."
+		render(w, r, http.StatusBadRequest, view)
+		return
+	}
+
+	view.UserCode = formatUserCode(req.UserCode)
+	describeDeviceRequest(&view, config, svcs, req)
+
+	user, err := svcs.Users().User(pending.UID)
+	if err != nil {
+		log.Printf("[Error] Failed to load user (%s) - %v", pending.UID, err)
+		view.Error = http.StatusText(http.StatusInternalServerError)
+		render(w, r, http.StatusInternalServerError, view)
+		return
+	}
+
+	limiter := loginLimiterFromContext(r.Context())
+	if limiter.locked(r, user.Username) {
+		view.Error = "Too many failed attempts, try again later."
+		render(w, r, http.StatusTooManyRequests, view)
+		return
+	}
+
+	if !checkSecondFactor(svcs, kvs, &user, r.PostFormValue("code"), config.TOTP.Skew) {
+		limiter.failed(r, user.Username)
+
+		pending.Attempts++
+		if pending.Attempts >= kMaxMFAAttempts {
+			log.Printf("[Error] Too many second factor attempts for user (%s).", user.ID)
+			view.Error = "Too many invalid codes, please start again."
+			render(w, r, http.StatusUnauthorized, view)
+			return
+		}
+
+		kvs.Set(kDeviceMFANamespace, rid, pending, time.Until(pending.Expires))
+		view.RequestID = rid
+		view.Error = "That code didn't work, try again."
+		render(w, r, http.StatusUnauthorized, view)
+		return
+	}
+
+	answerDeviceRequest(w, r, kvs, view, pending.DeviceCode, req, user.ID, true, []string{kAMRPassword, kAMROneTimePassword}, render)
+}
+
+// answerDeviceRequest records the user's answer for the polling device. Once
+// answered, the user code is spent.
+func answerDeviceRequest(w http.ResponseWriter, r *http.Request, kvs services.KeyValueStore, view deviceViewData, deviceCode string, req deviceRequest, uid string, approve bool, amr []string, render func(http.ResponseWriter, *http.Request, int, deviceViewData)) {
+	if _, err := kvs.ReadAndRemove(kUserCodeNamespace, req.UserCode); err != nil {
+		log.Printf("[Error] Device verification raced - %v", err)
+		view.Error = kDeviceAnsweredError.Error()
+		render(w, r, http.StatusConflict, view)
+		return
+	}
+
+	if approve {
+		req.Status = kStatusApproved
+		req.Grant.UID = uid
+		req.Grant.AuthTime = time.Now()
+		req.Grant.AMR = amr
+		view.Message = "Your device is now signed in. You can close this page."
+	} else {
+		req.Status = kStatusDenied
+		view.Message = "The sign in request was denied."
+	}
+
+	if err := kvs.Set(kDeviceCodeNamespace, deviceCode, req, deviceRequestTTL(req)); err != nil {
+		log.Printf("[Error] Failed to record device answer - %v", err)
+		view.Error = http.StatusText(http.StatusInternalServerError)
+		render(w, r, http.StatusInternalServerError, view)
+		return
+	}
+
+	view.Done = true
+	render(w, r, http.StatusOK, view)
+}
+
+// tokenFromDeviceCode is polled by the device (RFC 8628, Section 3.4) until
+// the user answers or the code expires.
+func tokenFromDeviceCode(w http.ResponseWriter, r *http.Request, config Config, minter *TokenMinter) {
+	deviceCode := r.PostFormValue("device_code")
+	if deviceCode == "" {
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "missing device_code")
+		return
+	}
+
+	svcs := services.ServicesFromContext(r.Context())
+	kvs := svcs.Ephemeral().KeyValues()
+
+	client, ok := requestClientForGrant(w, r, svcs, kGrantDeviceCode)
+	if !ok {
+		return
+	}
+
+	req, err := readDeviceRequest(kvs, deviceCode)
+	if err != nil {
+		log.Printf("[Error] Unknown device code - %v", err)
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "unknown device_code")
+		return
+	}
+
+	if req.Grant.ClientID != client.ID {
+		log.Print("[Error] Device code was not issued to the requesting client.")
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "client_id mismatch")
+		return
+	}
+
+	if time.Now().After(req.Expires) {
+		writeTokenError(w, http.StatusBadRequest, kExpiredTokenError, "")
+		return
+	}
+
+	switch req.Status {
+	case kStatusApproved:
+		if _, err := kvs.ReadAndRemove(kDeviceCodeNamespace, deviceCode); err != nil {
+			writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "device code already redeemed")
+			return
+		}
+
+		req.Grant.JKT = dpopKeyFromContext(r.Context())
+		req.Grant.X5T = clientCertThumbprint(r)
+		issueUserTokens(w, kvs, req.Grant, config, minter)
+
+	case kStatusDenied:
+		kvs.Remove(kDeviceCodeNamespace, deviceCode)
+		writeTokenError(w, http.StatusBadRequest, kAccessDeniedError, "")
+
+	default:
+		now := time.Now()
+		errS := kAuthorizationPendingError
+		if now.Sub(req.LastPoll) < req.Interval {
+			// Section 3.5: the interval grows by five seconds for every offence
+			req.Interval += kSlowDownIncrement
+			errS = kSlowDownError
+		}
+
+		req.LastPoll = now
+		if err := kvs.Set(kDeviceCodeNamespace, deviceCode, req, deviceRequestTTL(req)); err != nil {
+			log.Printf("[Error] Failed to record device poll - %v", err)
+		}
+
+		writeTokenError(w, http.StatusBadRequest, errS, "")
+	}
+}
+
+func readDeviceRequest(kvs services.KeyValueStore, deviceCode string) (deviceRequest, error) {
+	value, err := kvs.Read(kDeviceCodeNamespace, deviceCode)
+	if err != nil {
+		return deviceRequest{}, err
+	}
+
+	req, ok := value.(deviceRequest)
+	if !ok {
+		return deviceRequest{}, kDeviceStateError
+	}
+
+	return req, nil
+}
+
+func readDeviceRequestByUserCode(kvs services.KeyValueStore, userCode string) (string, deviceRequest, error) {
+	value, err := kvs.Read(kUserCodeNamespace, userCode)
+	if err != nil {
+		return "", deviceRequest{}, kUnknownUserCodeError
+	}
+
+	deviceCode, ok := value.(string)
+	if !ok || deviceCode == "" {
+		return "", deviceRequest{}, kUnknownUserCodeError
+	}
+
+	req, err := readDeviceRequest(kvs, deviceCode)
+	if err != nil || req.Status != kStatusPending || time.Now().After(req.Expires) {
+		return "", deviceRequest{}, kUnknownUserCodeError
+	}
+
+	return deviceCode, req, nil
+}
+
+// deviceRequestTTL keeps a device request around for kExpiredDeviceCodeTTL
+// past its expiry.
+func deviceRequestTTL(req deviceRequest) time.Duration {
+	return time.Until(req.Expires) + kExpiredDeviceCodeTTL
+}
+
+// describeDeviceRequest fills in the client and scopes behind a device
+// request, the way the consent page describes an authorization request.
+func describeDeviceRequest(view *deviceViewData, config Config, svcs services.Services, req deviceRequest) {
+	view.Scopes = describeScopes(config, req.Grant.Scope)
+	if client, err := svcs.Clients().Client(req.Grant.ClientID); err == nil {
+		view.ClientName = client.Name
+		view.ClientLogo = client.LogoURI
+	}
+	if view.ClientName == "" {
+		view.ClientName = req.Grant.ClientID
+	}
+}
+
+// formatUserCode splits a user code in half for readability (BCDF-GHJK).
+func formatUserCode(code string) string {
+	if len(code) < 2 {
+		return code
+	}
+
+	return code[:len(code)/2] + "-" + code[len(code)/2:]
+}
+
+// normalizeUserCode undoes formatting and the usual typing slips.
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// requestBase is endpointBase when an issuer is configured, otherwise it is
+// reconstructed from the request.
+func requestBase(r *http.Request, config Config) string {
+	if config.Issuer != "" {
+		return endpointBase(config)
+	}
+
+	return requestOrigin(r, config) + strings.TrimSuffix(config.Path, "/")
+}
+
+// requestOrigin is the issuer's origin when one is configured, otherwise the
+// origin the request was made to.
+func requestOrigin(r *http.Request, config Config) string {
+	if u, err := url.Parse(config.Issuer); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
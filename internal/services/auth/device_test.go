@@ -0,0 +1,136 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestUserCodeFormatting(t *testing.T) {
+	test.Expect(t, "BCDF-GHJK", formatUserCode("BCDFGHJK"), "user code is split in half")
+	test.Expect(t, "BCDFGHJK", normalizeUserCode("BCDF-GHJK"), "dash is dropped")
+	test.Expect(t, "BCDFGHJK", normalizeUserCode(" bcdf ghjk"), "case and spaces are forgiven")
+}
+
+func TestDeviceCodePolling(t *testing.T) {
+	config := testConfig()
+	minter := testMinter(t, config)
+	svcs, kvs := testServices(services.Client{ID: "tv", Name: "Television", Type: services.ClientTypePublic, GrantTypes: []string{kGrantDeviceCode}})
+
+	poll := func(deviceCode string) string {
+		form := url.Values{"grant_type": {kGrantDeviceCode}, "client_id": {"tv"}, "device_code": {deviceCode}}
+
+		w := httptest.NewRecorder()
+		tokenFromDeviceCode(w, formRequest(svcs, "/auth/token", form), config, minter)
+		_, body := decodeResponse(t, w)
+		return body["error"].(string)
+	}
+
+	req := deviceRequest{
+		Grant:   services.AuthCodeData{ClientID: "tv", Scope: "read"},
+		Status:  kStatusPending,
+		Expires: time.Now().Add(time.Minute),
+	}
+	live, err := storeWithRandomKey(kvs, kDeviceCodeNamespace, kDeviceCodeSize, req, deviceRequestTTL(req))
+	test.NoError(t, err, "storing live device request")
+
+	req.Expires = time.Now().Add(-time.Second)
+	expired, err := storeWithRandomKey(kvs, kDeviceCodeNamespace, kDeviceCodeSize, req, deviceRequestTTL(req))
+	test.NoError(t, err, "storing expired device request")
+
+	test.Expect(t, kAuthorizationPendingError, poll(live), "waiting on the user")
+	test.Expect(t, kExpiredTokenError, poll(expired), "expired device code")
+	test.Expect(t, kInvalidGrantError, poll("garbage"), "device code never issued")
+
+	view := deviceViewData{}
+	describeDeviceRequest(&view, config, svcs, req)
+	test.Expect(t, "Television", view.ClientName, "verification page names the client")
+	test.Expect(t, 1, len(view.Scopes), "verification page lists the scopes")
+	test.Expect(t, "read", view.Scopes[0].Name, "verification page lists the scopes")
+}
+
+func TestDeviceVerificationSecondFactor(t *testing.T) {
+	config := testConfig()
+	svcs, kvs := testServices(services.Client{ID: "tv", Type: services.ClientTypePublic, GrantTypes: []string{kGrantDeviceCode}})
+	templates := template.Must(template.ParseFS(os.DirFS("../../../views/auth"), "*.html"))
+
+	user, err := services.NewUser("dude@example.com", "abides")
+	test.NoError(t, err, "creating user")
+	user.TOTPSecret, err = helpers.GenerateTOTPSecret()
+	test.NoError(t, err, "generating TOTP secret")
+	withTestUsers(svcs, kvs, user)
+
+	req := deviceRequest{
+		Grant:    services.AuthCodeData{ClientID: "tv", Scope: "read"},
+		UserCode: "BCDFGHJK",
+		Status:   kStatusPending,
+		Expires:  time.Now().Add(time.Minute),
+	}
+	deviceCode, err := storeWithRandomKey(kvs, kDeviceCodeNamespace, kDeviceCodeSize, req, deviceRequestTTL(req))
+	test.NoError(t, err, "storing device request")
+	test.NoError(t, kvs.Set(kUserCodeNamespace, req.UserCode, deviceCode, time.Minute), "linking user code")
+
+	post := func(form url.Values) (int, string) {
+		w := httptest.NewRecorder()
+		DeviceVerification(templates, config)(w, formRequest(svcs, "/auth/device", form))
+		return w.Code, w.Body.String()
+	}
+	answer := func() deviceRequest {
+		found, err := readDeviceRequest(kvs, deviceCode)
+		test.NoError(t, err, "reading device request")
+		return found
+	}
+
+	status, body := post(url.Values{"user_code": {"bcdf-ghjk"}, "user": {"dude@example.com"}, "pwd": {"abides"}, "action": {kActionApprove}})
+	test.Expect(t, http.StatusOK, status, "password is accepted")
+	test.Expect(t, kStatusPending, answer().Status, "password alone doesn't approve")
+
+	match := regexp.MustCompile(`name="rid" value="([^"]+)"`).FindStringSubmatch(body)
+	test.Require(t, match != nil, "page asks for the second factor")
+	rid := match[1]
+
+	status, _ = post(url.Values{"rid": {rid}, "code": {"000000"}})
+	test.Expect(t, http.StatusUnauthorized, status, "wrong code")
+	test.Expect(t, kStatusPending, answer().Status, "wrong code doesn't approve")
+
+	code, err := helpers.TOTPCode(user.TOTPSecret, helpers.TOTPCounter(time.Now()))
+	test.NoError(t, err, "computing TOTP code")
+	status, _ = post(url.Values{"rid": {rid}, "code": {code}})
+	test.Expect(t, http.StatusOK, status, "right code")
+
+	found := answer()
+	test.Expect(t, kStatusApproved, found.Status, "device is approved")
+	test.Expect(t, user.ID, found.Grant.UID, "approving user is recorded")
+	test.Expect(t, 2, len(found.Grant.AMR), "password and otp are both recorded")
+}
@@ -0,0 +1,206 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"shiftylogic.dev/site-plat/internal/web"
+)
+
+const (
+	kJWKSRoute = "/jwks.json"
+
+	kOpenIDConfigurationPath = "/.well-known/openid-configuration"
+	kServerMetadataPath      = "/.well-known/oauth-authorization-server"
+)
+
+// Authorization server metadata (RFC 8414), which is a superset of what
+// OpenID Connect Discovery requires.
+type serverMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint,omitempty"`
+	TokenEndpoint         string `json:"token_endpoint,omitempty"`
+	JWKSURI               string `json:"jwks_uri,omitempty"`
+	IntrospectionEndpoint string `json:"introspection_endpoint,omitempty"`
+	RevocationEndpoint    string `json:"revocation_endpoint,omitempty"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint,omitempty"`
+	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+
+	DeviceAuthorizationEndpoint        string `json:"device_authorization_endpoint,omitempty"`
+	RegistrationEndpoint               string `json:"registration_endpoint,omitempty"`
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint,omitempty"`
+
+	ScopesSupported               []string `json:"scopes_supported,omitempty"`
+	ResponseTypesSupported        []string `json:"response_types_supported"`
+	ResponseModesSupported        []string `json:"response_modes_supported,omitempty"`
+	GrantTypesSupported           []string `json:"grant_types_supported,omitempty"`
+	CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported,omitempty"`
+	SubjectTypesSupported         []string `json:"subject_types_supported"`
+
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported,omitempty"`
+	TokenEndpointAuthSigningAlgValuesSupported []string `json:"token_endpoint_auth_signing_alg_values_supported,omitempty"`
+	IntrospectionEndpointAuthMethodsSupported  []string `json:"introspection_endpoint_auth_methods_supported,omitempty"`
+	RevocationEndpointAuthMethodsSupported     []string `json:"revocation_endpoint_auth_methods_supported,omitempty"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported,omitempty"`
+	ClaimsSupported                            []string `json:"claims_supported,omitempty"`
+	DPoPSigningAlgValuesSupported              []string `json:"dpop_signing_alg_values_supported,omitempty"`
+
+	// RFC 9207
+	AuthorizationResponseISSParameterSupported bool `json:"authorization_response_iss_parameter_supported,omitempty"`
+	// RFC 8705
+	TLSClientCertificateBoundAccessTokens bool `json:"tls_client_certificate_bound_access_tokens,omitempty"`
+}
+
+// newServerMetadata describes the routes actually mounted on r, which is the
+// router that will be mounted at config.Path.
+func newServerMetadata(config Config, r web.Router) serverMetadata {
+	base := endpointBase(config)
+	endpoint := func(method, route string) string {
+		if !web.HasRoute(r, method, route) {
+			return ""
+		}
+		return base + route
+	}
+
+	grants := make([]string, 0)
+	for gt := range tokenGrants() {
+		grants = append(grants, gt)
+	}
+	sort.Strings(grants)
+
+	scopes := []string{}
+	claims := []string{"sub", "iss", "aud", "exp", "iat"}
+	var idTokenAlgs []string
+	if config.servesOpenID() {
+		scopes = append(scopes, kScopeOpenID)
+		claims = append(claims, "auth_time", "nonce", "amr", "at_hash")
+		idTokenAlgs = []string{config.Signing.Algorithm}
+	}
+	for scope, names := range kScopeClaims {
+		scopes = append(scopes, scope)
+		claims = append(claims, names...)
+	}
+	for scope := range config.Scopes {
+		if scope == kScopeOpenID && !config.servesOpenID() {
+			continue
+		}
+		if !hasScope(strings.Join(scopes, " "), scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	sort.Strings(scopes)
+
+	return serverMetadata{
+		Issuer:                config.Issuer,
+		AuthorizationEndpoint: endpoint(http.MethodGet, kAuthorizeRoute),
+		TokenEndpoint:         endpoint(http.MethodPost, kTokenRoute),
+		JWKSURI:               endpoint(http.MethodGet, kJWKSRoute),
+		IntrospectionEndpoint: endpoint(http.MethodPost, kIntrospectRoute),
+		RevocationEndpoint:    endpoint(http.MethodPost, kRevokeRoute),
+		UserInfoEndpoint:      endpoint(http.MethodGet, kUserInfoRoute),
+		EndSessionEndpoint:    endpoint(http.MethodGet, kLogoutRoute),
+
+		DeviceAuthorizationEndpoint:        endpoint(http.MethodPost, kDeviceAuthorizationRoute),
+		RegistrationEndpoint:               endpoint(http.MethodPost, kRegisterRoute),
+		PushedAuthorizationRequestEndpoint: endpoint(http.MethodPost, kPARRoute),
+
+		ScopesSupported:               scopes,
+		ResponseTypesSupported:        []string{"code"},
+		ResponseModesSupported:        kResponseModes,
+		GrantTypesSupported:           grants,
+		CodeChallengeMethodsSupported: []string{kChallengeMethodS256, kChallengeMethodPlain},
+		SubjectTypesSupported:         []string{"public"},
+
+		TokenEndpointAuthMethodsSupported:          append([]string{kClientAuthNone}, kClientAuthMethods...),
+		TokenEndpointAuthSigningAlgValuesSupported: kClientAssertionAlgorithms,
+		IntrospectionEndpointAuthMethodsSupported:  kClientAuthMethods,
+		RevocationEndpointAuthMethodsSupported:     append([]string{kClientAuthNone}, kClientAuthMethods...),
+		IDTokenSigningAlgValuesSupported:           idTokenAlgs,
+		ClaimsSupported:                            claims,
+		DPoPSigningAlgValuesSupported:              kDPoPAlgorithms,
+
+		AuthorizationResponseISSParameterSupported: true,
+		TLSClientCertificateBoundAccessTokens:      true,
+	}
+}
+
+// endpointBase is the issuer's origin followed by the path the auth routes
+// are mounted under.
+func endpointBase(config Config) string {
+	u, err := url.Parse(config.Issuer)
+	if err != nil {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host + strings.TrimSuffix(config.Path, "/")
+}
+
+// mountDiscovery serves the metadata from the locations both specs expect for
+// the issuer: OpenID Connect appends the well-known suffix to the issuer path,
+// RFC 8414 inserts it between the host and the path.
+func mountDiscovery(root, r web.Router, config Config, metadata serverMetadata) {
+	u, err := url.Parse(config.Issuer)
+	if err != nil || u.Host == "" {
+		log.Printf("[Error] Issuer (%s) is not an absolute URL, skipping discovery.", config.Issuer)
+		return
+	}
+
+	doc, err := json.Marshal(metadata)
+	if err != nil {
+		log.Printf("[Error] Failed to encode server metadata - %v", err)
+		return
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+
+	issuerPath := strings.TrimSuffix(u.Path, "/")
+	for _, p := range []string{issuerPath + kOpenIDConfigurationPath, kServerMetadataPath + issuerPath} {
+		// Anything under the auth mount point has to be routed by the sub-router
+		if prefix := strings.TrimSuffix(config.Path, "/"); prefix != "" && strings.HasPrefix(p, prefix+"/") {
+			r.Get(strings.TrimPrefix(p, prefix), handler)
+		} else {
+			root.Get(p, handler)
+		}
+	}
+}
+
+func JWKS(minter *TokenMinter) func(w http.ResponseWriter, r *http.Request) {
+	set, err := json.Marshal(minter.JWKS())
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to encode JWKS - %v", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		w.Write(set)
+	}
+}
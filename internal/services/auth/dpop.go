@@ -0,0 +1,393 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kDPoPHeader      = "DPoP"
+	kDPoPNonceHeader = "DPoP-Nonce"
+	kDPoPProofType   = "dpop+jwt"
+	kTokenTypeDPoP   = "DPoP"
+
+	kDPoPNonceSize = 24
+
+	kDPoPJTINamespace   = "dpop_jti"
+	kDPoPNonceNamespace = "dpop_nonce"
+
+	// RFC 9449 error codes
+	kInvalidDPoPProofError = "invalid_dpop_proof"
+	kUseDPoPNonceError     = "use_dpop_nonce"
+
+	kDPoPKeyContextKey     = "sl.auth.dpop_jkt"
+	kAccessTokenContextKey = "sl.auth.access_token"
+)
+
+var (
+	// Proofs are signed with a key only the client holds, so never HS256
+	kDPoPAlgorithms = []string{jwt.ES256, jwt.RS256, jwt.EdDSA}
+
+	kDPoPMissingError     = errors.New("no DPoP proof")
+	kDPoPMultipleError    = errors.New("more than one DPoP proof")
+	kDPoPTypeError        = errors.New("not a DPoP proof")
+	kDPoPAlgorithmError   = errors.New("unsupported DPoP proof algorithm")
+	kDPoPNoKeyError       = errors.New("DPoP proof carries no public key")
+	kDPoPMethodError      = errors.New("DPoP proof htm does not match the request")
+	kDPoPURIError         = errors.New("DPoP proof htu does not match the request")
+	kDPoPTimeError        = errors.New("DPoP proof iat is outside the accepted window")
+	kDPoPNoIDError        = errors.New("DPoP proof has no jti")
+	kDPoPReplayError      = errors.New("DPoP proof has already been used")
+	kDPoPHashError        = errors.New("DPoP proof ath does not match the access token")
+	kDPoPNonceError       = errors.New("DPoP proof is missing a current nonce")
+	kDPoPKeyMismatchError = errors.New("DPoP proof key does not match the token binding")
+	kDPoPUnboundError     = errors.New("access token is not DPoP bound")
+	kDPoPBearerError      = errors.New("DPoP bound access token presented as a bearer token")
+)
+
+// DPoPThumbprint returns the key thumbprint the token is bound to, or "" for
+// a plain bearer token.
+func (c *AccessTokenClaims) DPoPThumbprint() string {
+	if c.Confirmation == nil {
+		return ""
+	}
+
+	return c.Confirmation.JKT
+}
+
+type dpopClaims struct {
+	jwt.RegisteredClaims
+	Method          string `json:"htm"`
+	URI             string `json:"htu"`
+	AccessTokenHash string `json:"ath,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+}
+
+// checkDPoPProof validates the proof in the DPoP header (RFC 9449, Section
+// 4.3) and returns the thumbprint of the key that signed it. accessToken is
+// the token the proof accompanies, if any, which ath has to match.
+func checkDPoPProof(r *http.Request, kvs services.KeyValueStore, config Config, accessToken string) (string, error) {
+	proofs := r.Header.Values(kDPoPHeader)
+	if len(proofs) == 0 {
+		return "", kDPoPMissingError
+	}
+	if len(proofs) > 1 {
+		return "", kDPoPMultipleError
+	}
+
+	proof, err := jwt.Parse(proofs[0])
+	if err != nil {
+		return "", err
+	}
+
+	if proof.Header.Type != kDPoPProofType {
+		return "", kDPoPTypeError
+	}
+
+	if !dpopAlgorithm(proof.Header.Algorithm) {
+		return "", kDPoPAlgorithmError
+	}
+
+	if proof.Header.JWK == nil {
+		return "", kDPoPNoKeyError
+	}
+
+	key, err := proof.Header.JWK.PublicKey(proof.Header.Algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	if err := proof.Verify(key); err != nil {
+		return "", err
+	}
+
+	var claims dpopClaims
+	if err := proof.Claims(&claims); err != nil {
+		return "", err
+	}
+
+	if claims.Method != r.Method {
+		return "", kDPoPMethodError
+	}
+
+	if !sameTargetURI(claims.URI, dpopTargetURI(r, config)) {
+		return "", kDPoPURIError
+	}
+
+	window := config.DPoP.ProofWindow
+	if iat := time.Unix(claims.IssuedAt, 0); time.Since(iat) > window || time.Until(iat) > window {
+		return "", kDPoPTimeError
+	}
+
+	if accessToken != "" && claims.AccessTokenHash != dpopTokenHash(accessToken) {
+		return "", kDPoPHashError
+	}
+
+	if config.DPoP.RequireNonce {
+		if _, err := kvs.Read(kDPoPNonceNamespace, claims.Nonce); claims.Nonce == "" || err != nil {
+			return "", kDPoPNonceError
+		}
+	}
+
+	jkt, err := proof.Header.JWK.Thumbprint()
+	if err != nil {
+		return "", err
+	}
+
+	if claims.ID == "" {
+		return "", kDPoPNoIDError
+	}
+
+	// Anything older than the window is already refused, so a jti only has to
+	// be remembered for as long as its proof could still pass
+	if err := kvs.CheckAndSet(kDPoPJTINamespace, jkt+":"+claims.ID, true, 2*window); err != nil {
+		return "", kDPoPReplayError
+	}
+
+	return jkt, nil
+}
+
+func dpopAlgorithm(alg string) bool {
+	for _, a := range kDPoPAlgorithms {
+		if a == alg {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dpopTargetURI is the URL a proof for this request has to name in htu: the
+// request URL without its query.
+func dpopTargetURI(r *http.Request, config Config) string {
+	return requestOrigin(r, config) + r.URL.EscapedPath()
+}
+
+// sameTargetURI compares an htu claim to the request URL, ignoring the query
+// and fragment (RFC 9449, Section 4.3).
+func sameTargetURI(htu, target string) bool {
+	u, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+
+	t, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Scheme, t.Scheme) && strings.EqualFold(u.Host, t.Host) && u.EscapedPath() == t.EscapedPath()
+}
+
+// dpopTokenHash is the ath construction: the base64url encoded SHA-256 of the
+// access token.
+func dpopTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// newDPoPNonce hands out a nonce for clients to put in their next proofs. A
+// nonce can be used any number of times until it expires.
+func newDPoPNonce(kvs services.KeyValueStore, config Config) (string, error) {
+	return storeWithRandomKey(kvs, kDPoPNonceNamespace, kDPoPNonceSize, true, config.DPoP.NonceTTL)
+}
+
+// tokenType is the token_type reported for an access token bound to jkt.
+func tokenType(jkt string) string {
+	if jkt != "" {
+		return kTokenTypeDPoP
+	}
+
+	return kTokenTypeBearer
+}
+
+/**
+ *
+ * Token endpoint support: a proof sent with a token request binds every token
+ * issued for it to the proof's key.
+ *
+ **/
+
+// tokenRequestDPoP checks the proof on a token request, if there is one, and
+// returns the thumbprint the issued tokens should be bound to. Errors have
+// been written when ok is false.
+func tokenRequestDPoP(w http.ResponseWriter, r *http.Request, config Config) (string, bool) {
+	if len(r.Header.Values(kDPoPHeader)) == 0 {
+		return "", true
+	}
+
+	kvs := services.ServicesFromContext(r.Context()).Ephemeral().KeyValues()
+
+	jkt, err := checkDPoPProof(r, kvs, config, "")
+	if err == kDPoPNonceError {
+		if setDPoPNonce(w, kvs, config) {
+			writeTokenError(w, http.StatusBadRequest, kUseDPoPNonceError, err.Error())
+		} else {
+			writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		}
+		return "", false
+	}
+
+	if err != nil {
+		log.Printf("[Error] Invalid DPoP proof on token request - %v", err)
+		writeTokenError(w, http.StatusBadRequest, kInvalidDPoPProofError, err.Error())
+		return "", false
+	}
+
+	return jkt, true
+}
+
+func withDPoPKey(r *http.Request, jkt string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), kDPoPKeyContextKey, jkt))
+}
+
+// dpopKeyFromContext returns the thumbprint of the key that signed the token
+// request's DPoP proof, or "" for a plain bearer token request.
+func dpopKeyFromContext(ctx context.Context) string {
+	jkt, _ := ctx.Value(kDPoPKeyContextKey).(string)
+	return jkt
+}
+
+func setDPoPNonce(w http.ResponseWriter, kvs services.KeyValueStore, config Config) bool {
+	nonce, err := newDPoPNonce(kvs, config)
+	if err != nil {
+		log.Printf("[Error] Failed to generate DPoP nonce - %v", err)
+		return false
+	}
+
+	w.Header().Set(kDPoPNonceHeader, nonce)
+	return true
+}
+
+/**
+ *
+ * Resource server support
+ *
+ **/
+
+// RequireAccessToken is middleware for endpoints that take access tokens. It
+// accepts plain bearer tokens as well as DPoP bound tokens sent with a valid
+// proof, and refuses a bound token without its proof. Certificate bound tokens
+// are only accepted over a connection using the same client certificate. The
+// token's claims are available to the handler through AccessTokenFromContext.
+func RequireAccessToken(config Config, verifier *TokenVerifier) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			dpop := true
+			token, err := helpers.ParseHttpAuthDPoP(r)
+			if err != nil {
+				dpop = false
+				if token, err = helpers.ParseHttpAuthBearer(r); err != nil {
+					writeBearerError(w, http.StatusUnauthorized, "", "")
+					return
+				}
+			}
+
+			kvs := services.ServicesFromContext(r.Context()).Ephemeral().KeyValues()
+
+			claims, err := verifier.VerifyActive(kvs, token)
+			if err != nil {
+				log.Printf("[Error] Invalid access token - %v", err)
+				writeAccessTokenError(w, dpop, kInvalidTokenError, "")
+				return
+			}
+
+			bound := claims.DPoPThumbprint() != ""
+			switch {
+			case bound && !dpop:
+				log.Printf("[Error] Access token check failed - %v", kDPoPBearerError)
+				writeBearerError(w, http.StatusUnauthorized, kInvalidTokenError, kDPoPBearerError.Error())
+				return
+			case dpop && !bound:
+				log.Printf("[Error] Access token check failed - %v", kDPoPUnboundError)
+				writeDPoPError(w, kInvalidTokenError, kDPoPUnboundError.Error())
+				return
+			case bound:
+				jkt, err := checkDPoPProof(r, kvs, config, token)
+				if err == nil && jkt != claims.DPoPThumbprint() {
+					err = kDPoPKeyMismatchError
+				}
+
+				if err == kDPoPNonceError {
+					if !setDPoPNonce(w, kvs, config) {
+						http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+						return
+					}
+					writeDPoPError(w, kUseDPoPNonceError, err.Error())
+					return
+				}
+
+				if err != nil {
+					log.Printf("[Error] Invalid DPoP proof on resource request - %v", err)
+					writeDPoPError(w, kInvalidDPoPProofError, err.Error())
+					return
+				}
+			}
+
+			if x5t := claims.CertificateThumbprint(); x5t != "" && x5t != clientCertThumbprint(r) {
+				log.Printf("[Error] Access token check failed - %v", kCertBindingError)
+				writeAccessTokenError(w, dpop, kInvalidTokenError, kCertBindingError.Error())
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), kAccessTokenContextKey, claims)))
+		})
+	}
+}
+
+// AccessTokenFromContext returns the claims of the token RequireAccessToken
+// accepted for the request.
+func AccessTokenFromContext(ctx context.Context) *AccessTokenClaims {
+	claims, _ := ctx.Value(kAccessTokenContextKey).(*AccessTokenClaims)
+	return claims
+}
+
+func writeAccessTokenError(w http.ResponseWriter, dpop bool, errS, desc string) {
+	if dpop {
+		writeDPoPError(w, errS, desc)
+		return
+	}
+
+	writeBearerError(w, http.StatusUnauthorized, errS, desc)
+}
+
+// writeDPoPError is writeBearerError for the DPoP scheme (RFC 9449, Section
+// 7.1), which also lists the proof algorithms that are accepted.
+func writeDPoPError(w http.ResponseWriter, errS, desc string) {
+	algs := fmt.Sprintf("algs=%q", strings.Join(kDPoPAlgorithms, " "))
+	writeChallenge(w, kTokenTypeDPoP, []string{algs}, http.StatusUnauthorized, errS, desc)
+}
@@ -0,0 +1,90 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestCheckDPoPProof(t *testing.T) {
+	kvs := services.NewMemoryStore(context.Background())
+	config := DefaultConfig()
+	config.Issuer = "https://issuer.example"
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.NoError(t, err, "generating proof key")
+	key, err := jwt.NewPrivateKey("", jwt.ES256, ek)
+	test.NoError(t, err, "wrapping proof key")
+	jwk, err := key.JWK()
+	test.NoError(t, err, "exporting proof key")
+	want, err := jwk.Thumbprint()
+	test.NoError(t, err, "thumbprint")
+
+	check := func(jti, method, uri, ath, token string) (string, error) {
+		proof, err := jwt.SignWithHeader(key, jwt.Header{Type: kDPoPProofType, JWK: &jwk}, dpopClaims{
+			RegisteredClaims: jwt.RegisteredClaims{ID: jti, IssuedAt: time.Now().Unix()},
+			Method:           method,
+			URI:              uri,
+			AccessTokenHash:  ath,
+		})
+		test.NoError(t, err, "signing proof")
+
+		r := httptest.NewRequest(http.MethodGet, "/api/things?page=2", nil)
+		r.Header.Set(kDPoPHeader, proof)
+		return checkDPoPProof(r, kvs, config, token)
+	}
+
+	jkt, err := check("one", http.MethodGet, "https://issuer.example/api/things", "", "")
+	test.NoError(t, err, "valid proof")
+	test.Expect(t, want, jkt, "proof key thumbprint")
+
+	_, err = check("one", http.MethodGet, "https://issuer.example/api/things", "", "")
+	test.SpecificError(t, err, kDPoPReplayError, "jti can't be reused")
+
+	_, err = check("two", http.MethodPost, "https://issuer.example/api/things", "", "")
+	test.SpecificError(t, err, kDPoPMethodError, "htm must match")
+
+	_, err = check("three", http.MethodGet, "https://issuer.example/api/other", "", "")
+	test.SpecificError(t, err, kDPoPURIError, "htu must match")
+
+	_, err = check("four", http.MethodGet, "https://issuer.example/api/things", dpopTokenHash("other"), "token")
+	test.SpecificError(t, err, kDPoPHashError, "ath must match the token")
+
+	_, err = check("five", http.MethodGet, "https://issuer.example/api/things", dpopTokenHash("token"), "token")
+	test.NoError(t, err, "ath for the presented token")
+
+	config.DPoP.RequireNonce = true
+	_, err = check("six", http.MethodGet, "https://issuer.example/api/things", "", "")
+	test.SpecificError(t, err, kDPoPNonceError, "nonce is required")
+}
@@ -0,0 +1,286 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kGrantTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	// Token type identifiers (RFC 8693, Section 3). Access tokens from this
+	// service are JWTs, so either name is accepted for them.
+	kTokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	kTokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+
+	kInvalidTargetError = "invalid_target"
+
+	// Longest act chain an exchange may produce
+	kMaxActorDepth = 5
+)
+
+var (
+	kUnsupportedTokenTypeError  = errors.New("unsupported token type")
+	kExchangeSubjectClientError = errors.New("subject token was issued to a client whose tokens may not be exchanged")
+	kExchangeBindingError       = errors.New("token is bound to a key the request does not prove possession of")
+	kDelegationNotAllowedError  = errors.New("delegation is not allowed for this client")
+	kMissingActorTokenError     = errors.New("actor_token_type sent without an actor_token")
+	kActorClientError           = errors.New("actor token was not issued to the requesting client")
+	kActorDepthError            = errors.New("delegation chain is too long")
+	kInvalidResourceError       = errors.New("resource must be an absolute URI without a fragment")
+	kTargetNotAllowedError      = errors.New("requested audience or resource is not allowed for this client")
+)
+
+// Actor is the act claim (RFC 8693, Section 4.1): who is acting for the
+// token's subject. Earlier actors in a delegation chain are nested inside.
+type Actor struct {
+	Subject  string `json:"sub"`
+	ClientID string `json:"client_id,omitempty"`
+	Actor    *Actor `json:"act,omitempty"`
+}
+
+func (a *Actor) depth() int {
+	n := 0
+	for ; a != nil; a = a.Actor {
+		n++
+	}
+
+	return n
+}
+
+// tokenFromTokenExchange trades an access token for a new one (RFC 8693),
+// usually narrower in scope and aimed at another service. Sending an
+// actor_token makes it a delegation: the new token's act claim names the
+// actor on top of whatever chain the subject token carried. Without one the
+// exchange is impersonation and the chain is kept as it was.
+func tokenFromTokenExchange(w http.ResponseWriter, r *http.Request, config Config, minter *TokenMinter) {
+	svcs := services.ServicesFromContext(r.Context())
+	kvs := svcs.Ephemeral().KeyValues()
+
+	client, err := authenticateClient(r, svcs)
+	if err != nil {
+		log.Printf("[Error] Client authentication failed - %v", err)
+		writeClientAuthError(w, r, err)
+		return
+	}
+
+	if !client.AllowsGrant(kGrantTokenExchange) {
+		log.Printf("[Error] Client (%s) is not registered for the %s grant.", client.ID, kGrantTokenExchange)
+		writeTokenError(w, http.StatusBadRequest, kUnauthorizedClientError, "grant type not allowed for this client")
+		return
+	}
+
+	policy, ok := config.TokenExchange[client.ID]
+	if !ok {
+		log.Printf("[Error] Client (%s) has no token exchange policy.", client.ID)
+		writeTokenError(w, http.StatusBadRequest, kUnauthorizedClientError, "token exchange is not allowed for this client")
+		return
+	}
+
+	if rtt := r.PostFormValue("requested_token_type"); rtt != "" && rtt != kTokenTypeAccessToken {
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "only access tokens can be requested")
+		return
+	}
+
+	if r.PostFormValue("subject_token") == "" {
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "missing subject_token")
+		return
+	}
+
+	verifier := minter.Verifier()
+
+	subject, err := readExchangedToken(r, kvs, verifier, r.PostFormValue("subject_token"), r.PostFormValue("subject_token_type"))
+	if err == nil && subject.Claims.ClientID != client.ID && !listed(policy.SubjectClients, subject.Claims.ClientID) {
+		err = kExchangeSubjectClientError
+	}
+	if err != nil {
+		log.Printf("[Error] Token exchange refused the subject token - %v", err)
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "invalid subject_token: "+err.Error())
+		return
+	}
+
+	act, err := exchangeActor(r, kvs, verifier, policy, client.ID, subject.Claims.Actor)
+	if err != nil {
+		log.Printf("[Error] Token exchange refused the actor token - %v", err)
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "invalid actor_token: "+err.Error())
+		return
+	}
+
+	targets, err := exchangeTargets(r.PostForm, policy)
+	if err != nil {
+		log.Printf("[Error] Client (%s) asked for an exchange target it may not use - %v", client.ID, err)
+		writeTokenError(w, http.StatusBadRequest, kInvalidTargetError, err.Error())
+		return
+	}
+
+	scope := r.PostFormValue("scope")
+	if scope == "" {
+		scope = subject.Claims.Scope
+	} else if !scopeSubset(scope, subject.Claims.Scope) {
+		writeTokenError(w, http.StatusBadRequest, kInvalidScopeError, "scope exceeds the subject token's")
+		return
+	}
+
+	grant := services.AuthCodeData{
+		UID:      subject.Claims.Subject,
+		ClientID: client.ID,
+		Scope:    scope,
+		JKT:      dpopKeyFromContext(r.Context()),
+		X5T:      clientCertThumbprint(r),
+	}
+
+	claims, err := minter.accessTokenClaims(grant)
+	if err != nil {
+		log.Printf("[Error] Failed to issue access token - %v", err)
+		writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		return
+	}
+
+	if len(targets) > 0 {
+		claims.Audience = jwt.Audience(targets)
+	}
+	claims.Actor = act
+
+	// The new token never outlives the one it was made from, and dies with
+	// the same refresh token family.
+	if claims.ExpiresAt > subject.Claims.ExpiresAt {
+		claims.ExpiresAt = subject.Claims.ExpiresAt
+	}
+
+	token, _, err := minter.issueClaims(kvs, claims, subject.FamilyID)
+	if err != nil {
+		log.Printf("[Error] Failed to issue access token - %v", err)
+		writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		return
+	}
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken:     token,
+		IssuedTokenType: kTokenTypeAccessToken,
+		TokenType:       tokenType(grant.JKT),
+		ExpiresIn:       claims.ExpiresAt - time.Now().Unix(),
+		Scope:           scope,
+	})
+}
+
+// readExchangedToken checks a subject or actor token, which has to be an
+// active access token from this service. A bound token is only accepted
+// along with proof of its key, so an exchange can't strip the binding.
+func readExchangedToken(r *http.Request, kvs services.KeyValueStore, verifier *TokenVerifier, token, tokenType string) (accessTokenRecord, error) {
+	if tokenType != kTokenTypeAccessToken && tokenType != kTokenTypeJWT {
+		return accessTokenRecord{}, kUnsupportedTokenTypeError
+	}
+
+	claims, err := verifier.VerifyAccessToken(token)
+	if err != nil {
+		return accessTokenRecord{}, err
+	}
+
+	record, err := readAccessToken(kvs, claims.ID)
+	if err != nil {
+		return accessTokenRecord{}, err
+	}
+
+	if jkt := record.Claims.DPoPThumbprint(); jkt != "" && jkt != dpopKeyFromContext(r.Context()) {
+		return accessTokenRecord{}, kExchangeBindingError
+	}
+	if x5t := record.Claims.CertificateThumbprint(); x5t != "" && x5t != clientCertThumbprint(r) {
+		return accessTokenRecord{}, kExchangeBindingError
+	}
+
+	return record, nil
+}
+
+// exchangeActor returns the act claim for the new token. The actor has to be
+// the requesting client itself, proven by an access token issued to it.
+func exchangeActor(r *http.Request, kvs services.KeyValueStore, verifier *TokenVerifier, policy TokenExchangePolicy, cid string, chain *Actor) (*Actor, error) {
+	token := r.PostFormValue("actor_token")
+	if token == "" {
+		if r.PostFormValue("actor_token_type") != "" {
+			return nil, kMissingActorTokenError
+		}
+
+		return chain, nil
+	}
+
+	if !policy.Delegation {
+		return nil, kDelegationNotAllowedError
+	}
+
+	actor, err := readExchangedToken(r, kvs, verifier, token, r.PostFormValue("actor_token_type"))
+	if err != nil {
+		return nil, err
+	}
+
+	if actor.Claims.ClientID != cid {
+		return nil, kActorClientError
+	}
+
+	act := &Actor{Subject: actor.Claims.Subject, ClientID: actor.Claims.ClientID, Actor: chain}
+	if act.depth() > kMaxActorDepth {
+		return nil, kActorDepthError
+	}
+
+	return act, nil
+}
+
+// exchangeTargets collects the requested audience and resource values
+// (RFC 8693, Section 2.1; RFC 8707), all of which the policy has to allow.
+func exchangeTargets(form url.Values, policy TokenExchangePolicy) ([]string, error) {
+	targets := append([]string{}, form["audience"]...)
+
+	for _, resource := range form["resource"] {
+		u, err := url.Parse(resource)
+		if err != nil || !u.IsAbs() || u.Fragment != "" {
+			return nil, kInvalidResourceError
+		}
+
+		targets = append(targets, resource)
+	}
+
+	for _, target := range targets {
+		if !listed(policy.Audiences, target) {
+			return nil, kTargetNotAllowedError
+		}
+	}
+
+	return targets, nil
+}
+
+func listed(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
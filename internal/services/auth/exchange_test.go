@@ -0,0 +1,59 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"net/url"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestExchangeTargets(t *testing.T) {
+	policy := TokenExchangePolicy{Audiences: []string{"jobs", "https://jobs.example/api"}}
+
+	targets, err := exchangeTargets(url.Values{"audience": {"jobs"}, "resource": {"https://jobs.example/api"}}, policy)
+	test.NoError(t, err, "allowed audience and resource")
+	test.Expect(t, 2, len(targets), "both targets")
+
+	targets, err = exchangeTargets(url.Values{}, policy)
+	test.NoError(t, err, "no targets")
+	test.Expect(t, 0, len(targets), "no targets")
+
+	_, err = exchangeTargets(url.Values{"audience": {"billing"}}, policy)
+	test.SpecificError(t, err, kTargetNotAllowedError, "audience outside the policy")
+
+	_, err = exchangeTargets(url.Values{"resource": {"jobs"}}, policy)
+	test.SpecificError(t, err, kInvalidResourceError, "relative resource")
+
+	_, err = exchangeTargets(url.Values{"resource": {"https://jobs.example/api#x"}}, policy)
+	test.SpecificError(t, err, kInvalidResourceError, "resource with a fragment")
+}
+
+func TestActorDepth(t *testing.T) {
+	var chain *Actor
+	test.Expect(t, 0, chain.depth(), "no actor")
+
+	chain = &Actor{Subject: "gateway", Actor: &Actor{Subject: "edge"}}
+	test.Expect(t, 2, chain.depth(), "nested actor")
+}
@@ -0,0 +1,139 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+var kTestBadSecretError = errors.New("invalid client or secret")
+
+/**
+ *
+ * Shared setup for the handler tests
+ *
+ **/
+
+func testConfig() Config {
+	config := DefaultConfig()
+	config.Path = "/auth"
+	config.Issuer = "https://issuer.example"
+	config.Secret = "0123456789abcdef0123456789abcdef"
+
+	return config
+}
+
+func testServices(clients ...services.Client) (*services.ServicesContainer, services.KeyValueStore) {
+	kvs := services.NewMemoryStore(context.Background())
+	registry := services.NewClientRegistry(clients, kvs)
+
+	return &services.ServicesContainer{
+		EphemeralStore: &services.SimpleDataStore{KVS: kvs},
+		Authy:          testAuthorizer{clients: registry},
+		Registry:       registry,
+	}, kvs
+}
+
+// withTestUsers gives svcs a user directory, which the test authorizer then
+// signs users in against.
+func withTestUsers(svcs *services.ServicesContainer, kvs services.KeyValueStore, users ...services.User) {
+	dir := services.NewUserDirectory(services.UsersFile{Users: users}, kvs)
+	svcs.Directory = dir
+	svcs.Authy = testAuthorizer{clients: svcs.Registry, users: dir}
+}
+
+// testAuthorizer checks clients against the registry, passwords
+// against the user directory (if any) and takes QR codes at face value.
+// Nothing else in the Authorizer is used by the handlers under test.
+type testAuthorizer struct {
+	services.Authorizer
+	clients services.ClientRegistry
+	users   services.UserDirectory
+}
+
+func (a testAuthorizer) Authenticate(user, pwd string) (string, error) {
+	if a.users == nil {
+		return "", kTestBadSecretError
+	}
+
+	u, err := a.users.Authenticate(user, pwd)
+	if err != nil {
+		return "", err
+	}
+
+	return u.ID, nil
+}
+
+func (a testAuthorizer) AuthenticateClient(cid, secret string) (services.Client, error) {
+	client, err := a.clients.Client(cid)
+	if err != nil || !client.VerifySecret(secret) {
+		return services.Client{}, kTestBadSecretError
+	}
+
+	return client, nil
+}
+
+func (a testAuthorizer) ValidateClient(cid, redir string) bool {
+	client, err := a.clients.Client(cid)
+	return err == nil && client.AllowsRedirect(redir)
+}
+
+// VerifyQRRequest accepts any code whose token is the request ID itself.
+func (a testAuthorizer) VerifyQRRequest(ts, token, hash string, ttl time.Duration) (string, error) {
+	return token, nil
+}
+
+func testMinter(t *testing.T, config Config) *TokenMinter {
+	minter, err := NewTokenMinter(config)
+	test.NoError(t, err, "creating token minter")
+
+	return minter
+}
+
+// formRequest is a form POST carrying svcs in its context, as WithServices
+// would set it up.
+func formRequest(svcs services.Services, target string, form url.Values) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return r.WithContext(context.WithValue(r.Context(), services.ServicesContextKey, svcs))
+}
+
+// decodeResponse returns the status and JSON body of a recorded response.
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder) (int, map[string]any) {
+	body := map[string]any{}
+	test.NoError(t, json.Unmarshal(w.Body.Bytes(), &body), "decoding response")
+
+	return w.Code, body
+}
@@ -0,0 +1,133 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"log"
+	"net/http"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kTokenTypeHintAccess  = "access_token"
+	kTokenTypeHintRefresh = "refresh_token"
+)
+
+type introspectionResponse struct {
+	Active    bool         `json:"active"`
+	Scope     string       `json:"scope,omitempty"`
+	ClientID  string       `json:"client_id,omitempty"`
+	Subject   string       `json:"sub,omitempty"`
+	Audience  jwt.Audience `json:"aud,omitempty"`
+	Issuer    string       `json:"iss,omitempty"`
+	ExpiresAt int64        `json:"exp,omitempty"`
+	IssuedAt  int64        `json:"iat,omitempty"`
+	ID        string       `json:"jti,omitempty"`
+	TokenType string       `json:"token_type,omitempty"`
+
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	Actor        *Actor        `json:"act,omitempty"`
+}
+
+// Introspect implements RFC 7662. Only tokens this service issued, and that
+// are still recorded in the ephemeral store, are reported as active.
+func Introspect(minter *TokenMinter) func(w http.ResponseWriter, r *http.Request) {
+	verifier := minter.Verifier()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+
+		if _, err := authenticateClient(r, svcs); err != nil {
+			log.Printf("[Error] Client authentication failed on introspection - %v", err)
+			writeClientAuthError(w, r, err)
+			return
+		}
+
+		token := r.PostFormValue("token")
+		if token == "" {
+			writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "missing token")
+			return
+		}
+
+		kvs := svcs.Ephemeral().KeyValues()
+
+		// The hint only decides which lookup goes first
+		lookups := []func() (introspectionResponse, bool){
+			func() (introspectionResponse, bool) { return introspectAccessToken(kvs, verifier, token) },
+			func() (introspectionResponse, bool) { return introspectRefreshToken(kvs, token) },
+		}
+		if r.PostFormValue("token_type_hint") == kTokenTypeHintRefresh {
+			lookups[0], lookups[1] = lookups[1], lookups[0]
+		}
+
+		for _, lookup := range lookups {
+			if resp, ok := lookup(); ok {
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+		}
+
+		writeJSON(w, http.StatusOK, introspectionResponse{Active: false})
+	}
+}
+
+func introspectAccessToken(kvs services.KeyValueStore, verifier *TokenVerifier, token string) (introspectionResponse, bool) {
+	record, err := verifier.VerifyActive(kvs, token)
+	if err != nil {
+		return introspectionResponse{}, false
+	}
+
+	return introspectionResponse{
+		Active:    true,
+		Scope:     record.Scope,
+		ClientID:  record.ClientID,
+		Subject:   record.Subject,
+		Audience:  record.Audience,
+		Issuer:    record.Issuer,
+		ExpiresAt: record.ExpiresAt,
+		IssuedAt:  record.IssuedAt,
+		ID:        record.ID,
+		TokenType: tokenType(record.DPoPThumbprint()),
+
+		Confirmation: record.Confirmation,
+		Actor:        record.Actor,
+	}, true
+}
+
+func introspectRefreshToken(kvs services.KeyValueStore, token string) (introspectionResponse, bool) {
+	data, _, err := readRefreshToken(kvs, token)
+	if err != nil || refreshTokenUsed(kvs, token) {
+		return introspectionResponse{}, false
+	}
+
+	return introspectionResponse{
+		Active:    true,
+		Scope:     data.Grant.Scope,
+		ClientID:  data.Grant.ClientID,
+		Subject:   data.Grant.UID,
+		ExpiresAt: data.Expires.Unix(),
+		IssuedAt:  data.IssuedAt.Unix(),
+	}, true
+}
@@ -0,0 +1,78 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestIntrospect(t *testing.T) {
+	config := testConfig()
+	minter := testMinter(t, config)
+	svcs, kvs := testServices(
+		services.Client{ID: "app", Type: services.ClientTypePublic},
+		services.Client{ID: "api", Type: services.ClientTypeConfidential, SecretHash: services.HashClientSecret("api-secret")},
+	)
+
+	grant := services.AuthCodeData{UID: "dude", ClientID: "app", Scope: "read"}
+	fid, refresh, err := startRefreshFamily(kvs, grant, config)
+	test.NoError(t, err, "starting refresh family")
+	access, _, err := minter.Issue(kvs, grant, fid)
+	test.NoError(t, err, "issuing access token")
+
+	introspect := func(form url.Values) (int, map[string]any) {
+		w := httptest.NewRecorder()
+		Introspect(minter)(w, formRequest(svcs, "/auth/introspect", form))
+		return decodeResponse(t, w)
+	}
+	asAPI := func(token string) map[string]any {
+		status, body := introspect(url.Values{"client_id": {"api"}, "client_secret": {"api-secret"}, "token": {token}})
+		test.Expect(t, http.StatusOK, status, "introspection answers")
+		return body
+	}
+
+	body := asAPI(access)
+	test.Expect(t, true, body["active"], "access token is active")
+	test.Expect(t, "app", body["client_id"], "issued to the app")
+	test.Expect(t, "dude", body["sub"], "issued for the user")
+
+	test.Expect(t, true, asAPI(refresh)["active"], "refresh token is active")
+	test.Expect(t, false, asAPI("garbage")["active"], "unknown token")
+
+	status, body := introspect(url.Values{"client_id": {"api"}, "client_secret": {"wrong"}, "token": {access}})
+	test.Expect(t, http.StatusBadRequest, status, "bad client secret")
+	test.Expect(t, kInvalidClientError, body["error"], "bad client secret")
+
+	status, _ = introspect(url.Values{"client_id": {"app"}, "token": {access}})
+	test.Expect(t, http.StatusBadRequest, status, "public clients can't introspect")
+
+	revokeRefreshFamily(kvs, fid)
+	test.Expect(t, false, asAPI(access)["active"], "access token dies with its family")
+	test.Expect(t, false, asAPI(refresh)["active"], "refresh token dies with its family")
+}
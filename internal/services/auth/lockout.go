@@ -0,0 +1,220 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/web/throttle"
+)
+
+const (
+	kLoginLimiterContextKey = "sl.auth.limiter"
+
+	kLockedOutDescription = "too many failed attempts, try again later"
+)
+
+/**
+ *
+ * Brute-force protection for everything that checks a password or a client
+ * secret. Failures are counted per account (or client) and per remote address
+ * over a sliding window. Past LockoutConfig.DelayAfter failures each further
+ * failure is answered progressively slower; past the limits the account or
+ * address is refused outright until enough of the window has gone by for
+ * the count to decay, so nobody has to unlock anything by hand.
+ *
+ **/
+
+type loginLimiter struct {
+	config    LockoutConfig
+	accounts  throttle.LimitTracker
+	addresses throttle.LimitTracker
+}
+
+// newLoginLimiter returns nil when lockout is disabled; every method treats a
+// nil limiter as "no limits".
+func newLoginLimiter(config LockoutConfig) *loginLimiter {
+	if !config.Enabled {
+		return nil
+	}
+
+	if config.Window <= 0 {
+		config.Window = kDefaultLockoutWindow
+	}
+
+	return &loginLimiter{
+		config:    config,
+		accounts:  throttle.NewLocalTracker(config.Window),
+		addresses: throttle.NewLocalTracker(config.Window),
+	}
+}
+
+func loginLimiterFromContext(ctx context.Context) *loginLimiter {
+	limiter, _ := ctx.Value(kLoginLimiterContextKey).(*loginLimiter)
+	return limiter
+}
+
+// locked reports whether attempts for account (or from the request's address)
+// are currently refused.
+func (l *loginLimiter) locked(r *http.Request, account string) bool {
+	if l == nil {
+		return false
+	}
+
+	now := time.Now().UTC()
+
+	if n, err := l.addresses.Get(addressKey(r), now); err == nil && l.config.IPLimit > 0 && n >= l.config.IPLimit {
+		log.Printf("[Error] Address (%s) is locked out after %d failures.", remoteAddress(r), n)
+		return true
+	}
+
+	if account == "" {
+		return false
+	}
+
+	if n, err := l.accounts.Get(accountKey(account), now); err == nil && l.config.AccountLimit > 0 && n >= l.config.AccountLimit {
+		log.Printf("[Error] Account (%s) is locked out after %d failures.", account, n)
+		return true
+	}
+
+	return false
+}
+
+// failed records a failed attempt and then holds the request for the
+// progressive delay the account has earned.
+func (l *loginLimiter) failed(r *http.Request, account string) {
+	if l == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+
+	if _, err := l.addresses.Increment(addressKey(r), now); err != nil {
+		log.Printf("[Error] Failed to track login failure - %v", err)
+	}
+
+	if account == "" {
+		return
+	}
+
+	n, err := l.accounts.Increment(accountKey(account), now)
+	if err != nil {
+		log.Printf("[Error] Failed to track login failure - %v", err)
+		return
+	}
+
+	if delay := l.delay(n); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// delay doubles with every failure past DelayAfter, up to MaxDelay.
+func (l *loginLimiter) delay(failures uint) time.Duration {
+	if failures <= l.config.DelayAfter || l.config.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := l.config.BaseDelay
+	for i := l.config.DelayAfter + 1; i < failures && delay < l.config.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if l.config.MaxDelay > 0 && delay > l.config.MaxDelay {
+		delay = l.config.MaxDelay
+	}
+
+	return delay
+}
+
+// retryAfter is a Retry-After value (seconds) for a locked out request.
+func (l *loginLimiter) retryAfter() string {
+	return strconv.Itoa(int(l.config.Window.Seconds()))
+}
+
+// writeLockedOut answers a token endpoint request made while locked out.
+func (l *loginLimiter) writeLockedOut(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", l.retryAfter())
+	writeTokenError(w, http.StatusTooManyRequests, kAccessDeniedError, kLockedOutDescription)
+}
+
+func accountKey(account string) uint64 {
+	return throttle.KeyID("account:" + strings.ToLower(strings.TrimSpace(account)))
+}
+
+func addressKey(r *http.Request) uint64 {
+	return throttle.KeyID("address:" + remoteAddress(r))
+}
+
+func remoteAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// tokenRequestClientID is the lockout account for a request that carries
+// client credentials: the confidential client it claims to be, without
+// authenticating it. A public client has no secret to guess and its ID is no
+// secret either, so anything done in its name only counts against the
+// remote address; otherwise anyone could lock it out.
+func tokenRequestClientID(r *http.Request) string {
+	var cid string
+	if user, _, err := helpers.ParseHttpAuthBasic(r); err == nil {
+		if cid, err = url.QueryUnescape(user); err != nil {
+			return ""
+		}
+	} else if r.PostFormValue("client_assertion") != "" {
+		cid = assertionClientID(r)
+	} else if r.PostFormValue("client_secret") != "" {
+		cid = r.PostFormValue("client_id")
+	}
+
+	if cid == "" {
+		return ""
+	}
+
+	svcs, ok := r.Context().Value(services.ServicesContextKey).(services.Services)
+	if !ok {
+		return ""
+	}
+
+	if client, err := svcs.Clients().Client(cid); err != nil || !client.IsConfidential() {
+		return ""
+	}
+
+	return "client:" + cid
+}
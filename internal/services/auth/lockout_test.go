@@ -0,0 +1,147 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestLoginLimiterDelay(t *testing.T) {
+	config := DefaultConfig().Lockout
+	config.DelayAfter = 2
+	config.BaseDelay = time.Second
+	config.MaxDelay = 5 * time.Second
+	limiter := newLoginLimiter(config)
+
+	test.Expect(t, time.Duration(0), limiter.delay(2), "no delay up to DelayAfter")
+	test.Expect(t, time.Second, limiter.delay(3), "first delay is BaseDelay")
+	test.Expect(t, 4*time.Second, limiter.delay(5), "delay doubles")
+	test.Expect(t, 5*time.Second, limiter.delay(20), "delay is capped")
+}
+
+func TestLoginLimiterLocked(t *testing.T) {
+	config := DefaultConfig().Lockout
+	config.AccountLimit = 2
+	config.BaseDelay = 0
+	limiter := newLoginLimiter(config)
+	r := httptest.NewRequest("POST", "/auth/login", nil)
+
+	limiter.failed(r, "dude")
+	test.Require(t, !limiter.locked(r, "dude"), "below the limit")
+	limiter.failed(r, "Dude")
+	test.Require(t, limiter.locked(r, "dude"), "accounts are case insensitive")
+	test.Require(t, !limiter.locked(r, "walter"), "other accounts are unaffected")
+
+	var disabled *loginLimiter
+	disabled.failed(r, "dude")
+	test.Require(t, !disabled.locked(r, "dude"), "disabled limiter never locks")
+}
+
+func TestTokenRequestClientID(t *testing.T) {
+	svcs, _ := testServices(
+		services.Client{ID: "app", Type: services.ClientTypePublic},
+		services.Client{ID: "api", Type: services.ClientTypeConfidential},
+	)
+
+	account := func(form url.Values, basic bool) string {
+		r := formRequest(svcs, "/auth/token", form)
+		if basic {
+			r.SetBasicAuth(form.Get("client_id"), "secret")
+		}
+		return tokenRequestClientID(r)
+	}
+
+	test.Expect(t, "", account(url.Values{"client_id": {"app"}}, false), "public client")
+	test.Expect(t, "", account(url.Values{"client_id": {"app"}, "client_secret": {"x"}}, false), "public client with a secret")
+	test.Expect(t, "", account(url.Values{"client_id": {"app"}}, true), "public client with basic auth")
+	test.Expect(t, "", account(url.Values{"client_id": {"api"}}, false), "no credentials presented")
+	test.Expect(t, "client:api", account(url.Values{"client_id": {"api"}, "client_secret": {"x"}}, false), "client_secret_post")
+	test.Expect(t, "client:api", account(url.Values{"client_id": {"api"}}, true), "client_secret_basic")
+	test.Expect(t, "", account(url.Values{"client_id": {"nobody"}}, true), "unknown client")
+}
+
+func TestLockoutGrantFailures(t *testing.T) {
+	config := testConfig()
+	config.Lockout.AccountLimit = 2
+	config.Lockout.BaseDelay = 0
+	limiter := newLoginLimiter(config.Lockout)
+	minter := testMinter(t, config)
+	svcs, _ := testServices(services.Client{ID: "app", Type: services.ClientTypePublic, GrantTypes: []string{kGrantAuthorizationCode, kGrantRefreshToken}})
+
+	post := func(grant func(http.ResponseWriter, *http.Request, Config, *TokenMinter), form url.Values) {
+		r := formRequest(svcs, "/auth/token", form)
+		grant(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), kLoginLimiterContextKey, limiter)), config, minter)
+	}
+
+	for i := 0; i < 3; i++ {
+		post(tokenFromAuthorizationCode, url.Values{"client_id": {"app"}, "code": {"bad"}})
+		post(tokenFromRefreshToken, url.Values{"client_id": {"app"}, "refresh_token": {"bad"}})
+	}
+
+	r := httptest.NewRequest("POST", "/auth/token", nil)
+	test.Require(t, !limiter.locked(r, "client:app"), "bad codes never lock the client out")
+}
+
+func TestLockoutSecondFactorFailures(t *testing.T) {
+	config := testConfig()
+	config.Lockout.AccountLimit = 2
+	config.Lockout.BaseDelay = 0
+	limiter := newLoginLimiter(config.Lockout)
+	templates := template.Must(template.ParseFS(os.DirFS("../../../views/auth"), "*.html"))
+	svcs, kvs := testServices()
+
+	user, err := services.NewUser("dude@example.com", "abides")
+	test.NoError(t, err, "creating user")
+	user.TOTPSecret, err = helpers.GenerateTOTPSecret()
+	test.NoError(t, err, "generating TOTP secret")
+	withTestUsers(svcs, kvs, user)
+
+	pending := mfaPending{Grant: services.AuthCodeData{UID: user.ID}, Expires: time.Now().Add(time.Minute)}
+	rid, err := storeWithRandomKey(kvs, kMFAPendingNamespace, kMFARequestIDSize, pending, time.Minute)
+	test.NoError(t, err, "parking login")
+
+	for i := 0; i < 2; i++ {
+		r := formRequest(svcs, "/auth/mfa", url.Values{"rid": {rid}, "code": {"bad"}})
+		w := httptest.NewRecorder()
+		SecondFactor(templates, config)(w, r.WithContext(context.WithValue(r.Context(), kLoginLimiterContextKey, limiter)))
+		test.Expect(t, http.StatusUnauthorized, w.Code, "bad code")
+	}
+
+	found, err := readMFAPending(kvs, rid)
+	test.NoError(t, err, "failed attempts put the login back")
+	test.Expect(t, 2, found.Attempts, "attempts are counted")
+
+	r := httptest.NewRequest("POST", "/auth/mfa", nil)
+	test.Require(t, limiter.locked(r, user.Username), "bad codes count against the account")
+}
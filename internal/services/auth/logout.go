@@ -0,0 +1,269 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/web"
+)
+
+const (
+	kLogoutRoute        = "/logout"
+	kLogoutConfirmRoute = "/logout/confirm"
+	kLogoutTemplate     = "logout.html"
+	kPendingNamespace   = "user_pending"
+
+	kLogoutRequestIDSize    = 20
+	kLogoutPendingTTL       = 5 * time.Minute
+	kLogoutPendingNamespace = "logout_pending"
+)
+
+/**
+ *
+ * Everything a user has in flight (authorization codes not yet redeemed,
+ * answered QR logins, second factor and consent pages) is stored under random
+ * keys. To purge it all on logout every such item is also listed under the
+ * user's ID. The index is best effort: items that expired on their own are
+ * simply gone by the time it is walked.
+ *
+ **/
+
+type pendingItem struct {
+	Namespace string
+	Key       string
+}
+
+type pendingIndex struct {
+	Items   []pendingItem
+	Expires time.Time
+}
+
+// A logout waiting for the user to confirm it
+type logoutRequest struct {
+	ClientID    string
+	RedirectURI string
+	State       string
+}
+
+// RequestID is set while the user is asked to confirm; Cancelled once they
+// chose to stay signed in.
+type logoutViewData struct {
+	RequestID string
+	Cancelled bool
+	Error     string
+	CSRFField template.HTML
+}
+
+// trackPending lists ns/key under uid until ttl has passed.
+func trackPending(kvs services.KeyValueStore, uid, ns, key string, ttl time.Duration) {
+	if uid == "" {
+		return
+	}
+
+	var index pendingIndex
+	if value, err := kvs.Read(kPendingNamespace, uid); err == nil {
+		index, _ = value.(pendingIndex)
+	}
+
+	// Drop whatever has certainly expired so the list doesn't grow unbounded
+	now := time.Now()
+	if index.Expires.Before(now) {
+		index.Items = nil
+	}
+
+	index.Items = append(index.Items, pendingItem{Namespace: ns, Key: key})
+	if expires := now.Add(ttl); expires.After(index.Expires) {
+		index.Expires = expires
+	}
+
+	if err := kvs.Set(kPendingNamespace, uid, index, time.Until(index.Expires)); err != nil {
+		log.Printf("[Error] Failed to track pending item for user (%s) - %v", uid, err)
+	}
+}
+
+// purgePending removes everything the user still has in flight.
+func purgePending(kvs services.KeyValueStore, uid string) {
+	value, err := kvs.ReadAndRemove(kPendingNamespace, uid)
+	if err != nil {
+		return
+	}
+
+	index, _ := value.(pendingIndex)
+	for _, item := range index.Items {
+		kvs.Remove(item.Namespace, item.Key)
+	}
+}
+
+// Logout is OpenID Connect RP-initiated logout: the browser session ends,
+// the user's pending codes and logins are purged and the browser is sent back
+// to the client or shown a signed-out page. Only a valid id_token_hint for
+// the signed-in user ends the session straight away; anything else could be
+// a forged link, so the user is asked to confirm first.
+func Logout(templates *template.Template, config Config, minter *TokenMinter) func(w http.ResponseWriter, r *http.Request) {
+	render := logoutRenderer(templates)
+	verifier := minter.Verifier()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+
+		req := logoutRequest{
+			ClientID:    r.FormValue("client_id"),
+			RedirectURI: r.FormValue("post_logout_redirect_uri"),
+			State:       r.FormValue("state"),
+		}
+
+		var hintSubject string
+		if hint := r.FormValue("id_token_hint"); hint != "" {
+			claims, err := verifier.VerifyIDTokenHint(hint)
+			if err != nil {
+				log.Printf("[Error] Invalid id_token_hint in logout request - %v", err)
+				render(w, r, http.StatusBadRequest, logoutViewData{Error: "The sign out request was invalid."})
+				return
+			}
+
+			if req.ClientID == "" && len(claims.Audience) > 0 {
+				req.ClientID = claims.Audience[0]
+			} else if req.ClientID != "" && !claims.Audience.Contains(req.ClientID) {
+				log.Print("[Error] Logout client_id does not match the id_token_hint audience.")
+				render(w, r, http.StatusBadRequest, logoutViewData{Error: "The sign out request was invalid."})
+				return
+			}
+
+			hintSubject = claims.Subject
+		}
+
+		// Only redirect to where the client is registered to receive users
+		if req.RedirectURI != "" && (req.ClientID == "" || !svcs.Authorizer().ValidateClient(req.ClientID, req.RedirectURI)) {
+			log.Print("[Error] Invalid client and / or post logout redirect URI in logout call.")
+			render(w, r, http.StatusBadRequest, logoutViewData{Error: "The sign out request was invalid."})
+			return
+		}
+
+		session, ok := sessionsFromContext(r.Context()).current(r, kvs)
+		if !ok || (hintSubject != "" && hintSubject == session.UID) {
+			endSession(w, r, kvs)
+			finishLogout(w, r, render, req)
+			return
+		}
+
+		rid, err := storeWithRandomKey(kvs, kLogoutPendingNamespace, kLogoutRequestIDSize, req, kLogoutPendingTTL)
+		if err != nil {
+			log.Printf("[Error] Failed to store logout request - %v", err)
+			render(w, r, http.StatusInternalServerError, logoutViewData{Error: http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+
+		http.Redirect(w, r, strings.TrimSuffix(config.Path, "/")+kLogoutConfirmRoute+"?rid="+rid, http.StatusSeeOther)
+	}
+}
+
+// LogoutConfirm asks the user whether to end their session for a logout
+// request that didn't prove where it came from. It sits behind CSRF
+// protection, so only the user's own click can answer it.
+func LogoutConfirm(templates *template.Template) func(w http.ResponseWriter, r *http.Request) {
+	render := logoutRenderer(templates)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		rid := r.FormValue("rid")
+
+		if r.Method == http.MethodGet {
+			if _, err := kvs.Read(kLogoutPendingNamespace, rid); err != nil {
+				render(w, r, http.StatusBadRequest, logoutViewData{Error: "The sign out request has expired."})
+				return
+			}
+
+			render(w, r, http.StatusOK, logoutViewData{RequestID: rid})
+			return
+		}
+
+		// Answering spends the request, whatever the answer was
+		value, err := kvs.ReadAndRemove(kLogoutPendingNamespace, rid)
+		req, ok := value.(logoutRequest)
+		if err != nil || !ok {
+			render(w, r, http.StatusBadRequest, logoutViewData{Error: "The sign out request has expired."})
+			return
+		}
+
+		if r.PostFormValue("action") != kActionApprove {
+			render(w, r, http.StatusOK, logoutViewData{Cancelled: true})
+			return
+		}
+
+		endSession(w, r, kvs)
+		finishLogout(w, r, render, req)
+	}
+}
+
+func logoutRenderer(templates *template.Template) func(http.ResponseWriter, *http.Request, int, logoutViewData) {
+	return func(w http.ResponseWriter, r *http.Request, status int, data logoutViewData) {
+		data.CSRFField = web.CSRFTemplateField(r)
+		w.WriteHeader(status)
+		if err := templates.ExecuteTemplate(w, kLogoutTemplate, data); err != nil {
+			log.Printf("[Error] Failed to execute 'logout' template - %v", err)
+		}
+	}
+}
+
+// endSession ends the browser's session, if any, and purges everything its
+// user still has in flight.
+func endSession(w http.ResponseWriter, r *http.Request, kvs services.KeyValueStore) {
+	sessions := sessionsFromContext(r.Context())
+	if session, ok := sessions.current(r, kvs); ok {
+		purgePending(kvs, session.UID)
+	}
+
+	sessions.end(w, r, kvs)
+}
+
+// finishLogout sends the browser back to the client, or shows the
+// signed-out page when there is nowhere (valid) to go.
+func finishLogout(w http.ResponseWriter, r *http.Request, render func(http.ResponseWriter, *http.Request, int, logoutViewData), req logoutRequest) {
+	if req.RedirectURI == "" {
+		render(w, r, http.StatusOK, logoutViewData{})
+		return
+	}
+
+	target, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		render(w, r, http.StatusOK, logoutViewData{})
+		return
+	}
+
+	if req.State != "" {
+		query := target.Query()
+		query.Set("state", req.State)
+		target.RawQuery = query.Encode()
+	}
+
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
@@ -0,0 +1,136 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestPurgePending(t *testing.T) {
+	kvs := services.NewMemoryStore(context.Background())
+
+	kvs.Set(services.AuthCodeNamespace, "code", "dude", time.Minute)
+	kvs.Set(kConsentPendingNamespace, "rid", "dude", time.Minute)
+	kvs.Set(services.AuthCodeNamespace, "other", "walter", time.Minute)
+
+	trackPending(kvs, "dude", services.AuthCodeNamespace, "code", time.Minute)
+	trackPending(kvs, "dude", kConsentPendingNamespace, "rid", time.Minute)
+	trackPending(kvs, "walter", services.AuthCodeNamespace, "other", time.Minute)
+
+	purgePending(kvs, "dude")
+
+	_, err := kvs.Read(services.AuthCodeNamespace, "code")
+	test.AnyError(t, err, "code is purged")
+	_, err = kvs.Read(kConsentPendingNamespace, "rid")
+	test.AnyError(t, err, "consent request is purged")
+	_, err = kvs.Read(services.AuthCodeNamespace, "other")
+	test.NoError(t, err, "other users are untouched")
+}
+
+func TestLogout(t *testing.T) {
+	config := testConfig()
+	svcs, kvs := testServices()
+	sessions := newSessionManager(config)
+	templates := template.Must(template.ParseFS(os.DirFS("../../../views/auth"), "*.html"))
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.NoError(t, err, "generating signing key")
+	key, err := jwt.NewPrivateKey("k", jwt.ES256, ek)
+	test.NoError(t, err, "wrapping signing key")
+	minter := &TokenMinter{key: key, keys: []*jwt.Key{key.Public()}, issuer: config.Issuer, ttl: time.Minute}
+
+	hint := func(uid string) string {
+		token, err := minter.MintIDToken(services.AuthCodeData{UID: uid, ClientID: "app"}, "access")
+		test.NoError(t, err, "minting ID token")
+		return token
+	}
+	withContext := func(r *http.Request, cookie *http.Cookie) *http.Request {
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		ctx := context.WithValue(r.Context(), services.ServicesContextKey, svcs)
+		return r.WithContext(context.WithValue(ctx, kSessionContextKey, sessions))
+	}
+	signIn := func(uid string) *http.Cookie {
+		w := httptest.NewRecorder()
+		sessions.start(w, withContext(httptest.NewRequest(http.MethodGet, "/auth/login", nil), nil), kvs, services.AuthCodeData{UID: uid})
+		kvs.Set(services.AuthCodeNamespace, uid, uid, time.Minute)
+		trackPending(kvs, uid, services.AuthCodeNamespace, uid, time.Minute)
+		return w.Result().Cookies()[0]
+	}
+	logout := func(cookie *http.Cookie, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Logout(templates, config, minter)(w, withContext(httptest.NewRequest(http.MethodGet, "/auth/logout?"+query, nil), cookie))
+		return w
+	}
+	signedIn := func(cookie *http.Cookie) bool {
+		_, ok := sessions.current(withContext(httptest.NewRequest(http.MethodGet, "/auth", nil), cookie), kvs)
+		return ok
+	}
+	purged := func(uid string) bool {
+		_, err := kvs.Read(services.AuthCodeNamespace, uid)
+		return err != nil
+	}
+
+	cookie := signIn("dude")
+	signIn("walter")
+
+	w := logout(cookie, "")
+	test.Expect(t, http.StatusSeeOther, w.Code, "no hint asks for confirmation")
+	test.Require(t, strings.HasPrefix(w.Header().Get("Location"), "/auth"+kLogoutConfirmRoute), "sent to the confirmation page")
+	test.Require(t, signedIn(cookie) && !purged("dude"), "nothing ends before confirmation")
+
+	w = logout(cookie, "id_token_hint="+hint("walter"))
+	test.Expect(t, http.StatusSeeOther, w.Code, "another user's hint asks for confirmation")
+	test.Require(t, !purged("walter"), "another user's pending items are left alone")
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	test.NoError(t, err, "parsing confirmation URL")
+	form := url.Values{"rid": {location.Query().Get("rid")}, "action": {kActionApprove}}
+	r := formRequest(svcs, "/auth"+kLogoutConfirmRoute, form)
+	w = httptest.NewRecorder()
+	LogoutConfirm(templates)(w, withContext(r, cookie))
+	test.Expect(t, http.StatusOK, w.Code, "confirmed logout")
+	test.Require(t, !signedIn(cookie) && purged("dude"), "confirmation ends the session")
+	test.Require(t, !purged("walter"), "only the signed-in user is purged")
+
+	cookie = signIn("dude")
+	w = logout(cookie, "id_token_hint="+hint("dude"))
+	test.Expect(t, http.StatusOK, w.Code, "matching hint signs out right away")
+	test.Require(t, !signedIn(cookie) && purged("dude"), "matching hint ends the session")
+}
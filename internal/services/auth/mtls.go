@@ -0,0 +1,200 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+var (
+	kNoClientCertError         = errors.New("no client certificate presented")
+	kUnverifiedClientCertError = errors.New("client certificate does not chain to a trusted CA")
+	kNoClientCertConfigError   = errors.New("client has no certificate configured for tls_client_auth")
+	kClientCertMismatchError   = errors.New("client certificate does not match the registered one")
+	kNotTLSClientError         = errors.New("client is not registered for TLS client authentication")
+	kCertBindingError          = errors.New("access token is bound to a different client certificate")
+)
+
+/**
+ *
+ * Mutual TLS client authentication and certificate bound access tokens
+ * (RFC 8705). Nothing here works unless the listener asks for client
+ * certificates (services.TLSConfig.ClientAuth).
+ *
+ **/
+
+// clientCertificate returns the certificate the client presented on the
+// connection, or nil.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+
+	return r.TLS.PeerCertificates[0]
+}
+
+// clientCertThumbprint returns the x5t#S256 value (RFC 8705, Section 3.1) of
+// the client's certificate, or "" when it presented none.
+func clientCertThumbprint(r *http.Request) string {
+	cert := clientCertificate(r)
+	if cert == nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CertificateThumbprint returns the client certificate thumbprint the token is
+// bound to, or "" when it isn't bound to one.
+func (c *AccessTokenClaims) CertificateThumbprint() string {
+	if c.Confirmation == nil {
+		return ""
+	}
+
+	return c.Confirmation.X5T
+}
+
+// authenticateClientCertificate authenticates a client by the certificate on
+// the connection, using whichever of the two RFC 8705 methods it is registered
+// for. PKI clients need a chain the listener verified plus the configured
+// subject; self-signed clients need a certificate holding one of their keys.
+func authenticateClientCertificate(r *http.Request, svcs services.Services, cid string) (services.Client, error) {
+	cert := clientCertificate(r)
+	if cert == nil {
+		return services.Client{}, kNoClientCertError
+	}
+
+	client, err := svcs.Clients().Client(cid)
+	if err != nil {
+		return services.Client{}, err
+	}
+
+	keys := clientKeysFromContext(r.Context())
+
+	switch client.AuthMethod {
+	case kClientAuthTLS:
+		if len(r.TLS.VerifiedChains) == 0 {
+			return services.Client{}, kUnverifiedClientCertError
+		}
+
+		subject, ok := keys.certificate(cid)
+		if !ok {
+			return services.Client{}, kNoClientCertConfigError
+		}
+
+		if !subject.matches(cert) {
+			return services.Client{}, kClientCertMismatchError
+		}
+
+	case kClientAuthSelfSignedTLS:
+		registered, err := keys.keys(cid)
+		if err != nil {
+			return services.Client{}, err
+		}
+
+		if !holdsKey(cert, registered) {
+			return services.Client{}, kClientCertMismatchError
+		}
+
+	default:
+		return services.Client{}, kNotTLSClientError
+	}
+
+	return client, nil
+}
+
+// certificate returns what a tls_client_auth client's certificate has to
+// carry.
+func (s *clientKeySet) certificate(cid string) (ClientCertConfig, bool) {
+	if s == nil {
+		return ClientCertConfig{}, false
+	}
+
+	subject, ok := s.config.ClientCerts[cid]
+	return subject, ok
+}
+
+// matches reports whether the certificate carries the configured subject DN
+// or SAN entry (RFC 8705, Section 2.1.2). Only the first field set is used,
+// and an empty configuration matches nothing.
+func (cc ClientCertConfig) matches(cert *x509.Certificate) bool {
+	switch {
+	case cc.SubjectDN != "":
+		return cert.Subject.String() == cc.SubjectDN
+
+	case cc.SANDNS != "":
+		for _, name := range cert.DNSNames {
+			if name == cc.SANDNS {
+				return true
+			}
+		}
+
+	case cc.SANURI != "":
+		for _, uri := range cert.URIs {
+			if uri.String() == cc.SANURI {
+				return true
+			}
+		}
+
+	case cc.SANIP != "":
+		ip := net.ParseIP(cc.SANIP)
+		for _, addr := range cert.IPAddresses {
+			if ip != nil && addr.Equal(ip) {
+				return true
+			}
+		}
+
+	case cc.SANEmail != "":
+		for _, email := range cert.EmailAddresses {
+			if email == cc.SANEmail {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// holdsKey reports whether the certificate's public key is one of the
+// client's registered keys. The TLS handshake already proved the client holds
+// the matching private key.
+func holdsKey(cert *x509.Certificate, keys []*jwt.Key) bool {
+	for _, key := range keys {
+		pub, ok := key.PublicKey().(interface{ Equal(crypto.PublicKey) bool })
+		if ok && pub.Equal(cert.PublicKey) {
+			return true
+		}
+	}
+
+	return false
+}
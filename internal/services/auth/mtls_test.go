@@ -0,0 +1,114 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func selfSignedCert(t *testing.T, cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	test.NoError(t, err, "generating certificate key")
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Partners"}},
+		DNSNames:     []string{cn + ".example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ek.PublicKey, ek)
+	test.NoError(t, err, "creating certificate")
+	cert, err := x509.ParseCertificate(der)
+	test.NoError(t, err, "parsing certificate")
+
+	return cert, ek
+}
+
+func TestClientCertMatches(t *testing.T) {
+	cert, _ := selfSignedCert(t, "partner")
+
+	test.Require(t, ClientCertConfig{SubjectDN: "CN=partner,O=Partners"}.matches(cert), "subject DN")
+	test.Require(t, ClientCertConfig{SANDNS: "partner.example"}.matches(cert), "DNS SAN")
+	test.Require(t, !ClientCertConfig{SubjectDN: "CN=partner"}.matches(cert), "partial subject DN")
+	test.Require(t, !ClientCertConfig{SANEmail: "partner@example"}.matches(cert), "missing SAN")
+	test.Require(t, !ClientCertConfig{}.matches(cert), "empty configuration")
+}
+
+func TestSelfSignedClientAuth(t *testing.T) {
+	cert, ek := selfSignedCert(t, "partner")
+	other, _ := selfSignedCert(t, "other")
+
+	key, err := jwt.NewPublicKey("partner-1", jwt.ES256, &ek.PublicKey)
+	test.NoError(t, err, "wrapping client key")
+	jwk, err := key.JWK()
+	test.NoError(t, err, "exporting client key")
+
+	config := DefaultConfig()
+	config.ClientKeys.Clients["partner"] = ClientKeySource{Keys: []jwt.JWK{jwk}}
+
+	kvs := services.NewMemoryStore(context.Background())
+	svcs := &services.ServicesContainer{
+		EphemeralStore: &services.SimpleDataStore{KVS: kvs},
+		Registry: services.NewClientRegistry([]services.Client{
+			{ID: "partner", Type: services.ClientTypeConfidential, AuthMethod: kClientAuthSelfSignedTLS},
+		}, kvs),
+	}
+	keys := newClientKeySet(config)
+
+	authenticate := func(cert *x509.Certificate) (*http.Request, error) {
+		form := url.Values{"client_id": {"partner"}}
+		r := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		r = r.WithContext(context.WithValue(r.Context(), kClientKeysContextKey, keys))
+
+		_, err := requestClient(r, svcs)
+		return r, err
+	}
+
+	r, err := authenticate(cert)
+	test.NoError(t, err, "registered key")
+	test.Require(t, clientCertThumbprint(r) != "", "certificate thumbprint")
+
+	_, err = authenticate(other)
+	test.SpecificError(t, err, kClientCertMismatchError, "unregistered key")
+}
@@ -23,57 +23,134 @@
 package auth
 
 import (
-	"fmt"
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"shiftylogic.dev/site-plat/internal/services"
 	"shiftylogic.dev/site-plat/internal/web"
 )
 
 const (
-	kAuthorizeRoute = "/authorize"
-	kLoginRoute     = "/login"
-	kTokenRoute     = "/token"
-	kQRImageRoute   = "/qrcode"
+	kAuthorizeRoute  = "/authorize"
+	kLoginRoute      = "/login"
+	kTokenRoute      = "/token"
+	kIntrospectRoute = "/introspect"
+	kRevokeRoute     = "/revoke"
+	kUserInfoRoute   = "/userinfo"
+	kQRImageRoute    = "/qrcode"
 
 	// UI Templates
-	kLoginTemplate = "login.html"
+	kLoginTemplate  = "login.html"
+	kDeviceTemplate = "device.html"
 
-	// Error strings for auth callback
+	// Authorization requests waiting on the login form
+	kLoginRequestIDSize    = 20
+	kLoginPendingTTL       = 10 * time.Minute
+	kLoginPendingNamespace = "login_pending"
+
+	// Error strings for auth callback and token responses (RFC 6749)
 	kAccessDeniedError       = "access_denied"
+	kInvalidClientError      = "invalid_client"
+	kInvalidGrantError       = "invalid_grant"
+	kInvalidRequestError     = "invalid_request"
+	kInvalidScopeError       = "invalid_scope"
 	kServerError             = "server_error"
+	kUnauthorizedClientError = "unauthorized_client"
 	kUnsupportedGrantType    = "unsupported_grant_type"
 	kUnsupportedResponseType = "unsupported_response_type"
 )
 
+// The validated authorization request stays on the server; the login form
+// only carries RequestID back.
 type loginViewData struct {
-	ClientID        string
-	RedirectURI     string
-	Scope           string
-	State           string
-	Challenge       string
-	ChallengeMethod string
-
-	QREnabled bool
+	RequestID  string
+	ClientName string
+	ClientLogo string
+
+	CSRFField template.HTML
+
+	QREnabled   bool
+	QRRequestID string
+	QRRefresh   int64
 }
 
 func WithOAuth2(config Config) web.RouterOptionFunc {
+	config.QRScan.Prefix = qrScanPrefix(config)
 	templates := template.Must(template.ParseFS(os.DirFS(config.Templates), "*.html"))
 
+	minter, err := NewTokenMinter(config)
+	if err != nil {
+		log.Fatalf("[ERROR] Failed to load token signing key - %v", err)
+	}
+
 	return func(root web.Router) {
 		r := web.NewRouter()
-
-		r.With(web.NoIFrame).Get(kAuthorizeRoute, Authorize(templates, config))
-		r.Get(kLoginRoute, Login(config))
-		r.Post(kLoginRoute, Login(config))
-		r.Post(kTokenRoute, Token(config))
+		r.Use(web.InjectContext(kLoginLimiterContextKey, newLoginLimiter(config.Lockout)))
+		r.Use(web.InjectContext(kSessionContextKey, newSessionManager(config)))
+		r.Use(web.InjectContext(kClientKeysContextKey, newClientKeySet(config)))
+
+		// Pages a person fills in: they can't be framed and their forms must
+		// carry the CSRF token. Logging in only happens through a POST so a
+		// forged link can't sign the browser in to someone else's account.
+		csrf := web.NewCSRF(web.CSRFOptions{
+			Key:        []byte(config.Secret),
+			CookiePath: cookiePath(config),
+			Secure:     strings.HasPrefix(config.Issuer, "https://"),
+		})
+		pages := r.With(web.NoIFrame, csrf.Handler)
+
+		pages.Get(kAuthorizeRoute, Authorize(templates, config))
+		pages.Post(kLoginRoute, Login(config))
+		pages.Get(kMFARoute, SecondFactor(templates, config))
+		pages.Post(kMFARoute, SecondFactor(templates, config))
+		pages.Get(kConsentRoute, Consent(templates, config))
+		pages.Post(kConsentRoute, Consent(templates, config))
+		pages.Get(kTOTPEnrollRoute, TOTPEnroll(templates, config))
+		pages.Post(kTOTPEnrollRoute, TOTPEnroll(templates, config))
+		pages.Get(kDeviceRoute, DeviceVerification(templates, config))
+		pages.Post(kDeviceRoute, DeviceVerification(templates, config))
+		pages.Get(kLogoutConfirmRoute, LogoutConfirm(templates))
+		pages.Post(kLogoutConfirmRoute, LogoutConfirm(templates))
+
+		// Endpoints called with an access token, bearer or DPoP bound
+		tokens := r.With(RequireAccessToken(config, minter.Verifier()))
+
+		// Relying parties send browsers here from their own sites
+		r.With(web.NoIFrame).Get(kLogoutRoute, Logout(templates, config, minter))
+		r.With(web.NoIFrame).Post(kLogoutRoute, Logout(templates, config, minter))
+		r.Post(kTokenRoute, Token(config, minter))
+		r.Post(kIntrospectRoute, Introspect(minter))
+		r.Post(kRevokeRoute, Revoke(minter))
+		r.Get(kJWKSRoute, JWKS(minter))
+		tokens.Get(kUserInfoRoute, UserInfo())
+		tokens.Post(kUserInfoRoute, UserInfo())
+		r.Post(kDeviceAuthorizationRoute, DeviceAuthorization(config))
+		r.Post(kPARRoute, PushedAuthorization(config))
+
+		if config.Registration.Enabled {
+			log.Print("[Warning] Client registration is enabled; registered clients are only as durable as the data store.")
+			r.Post(kRegisterRoute, Register(config))
+			r.Get(kRegisterClientRoute, ManageRegistration(config))
+			r.Put(kRegisterClientRoute, ManageRegistration(config))
+			r.Delete(kRegisterClientRoute, ManageRegistration(config))
+		}
 
 		if config.QRScan.Enabled {
 			r.Get(kQRImageRoute, QRGenerator(config.QRScan))
-			// r.Get("/do-a-thing", DoThing(config.QRScan.TTL))
+			tokens.Get(kQRScanRoute, QRScan(config.QRScan))
+			tokens.Post(kQRScanRoute, QRScan(config.QRScan))
+			r.Get(kQRStatusRoute, QRStatus())
+			r.Get(kQRLoginRoute, QRLogin(config))
+		}
+
+		// Metadata is generated last so it reflects every mounted route
+		if config.Issuer != "" {
+			mountDiscovery(root, r, config, newServerMetadata(config, r))
 		}
 
 		root.Mount(config.Path, r)
@@ -82,153 +159,200 @@ func WithOAuth2(config Config) web.RouterOptionFunc {
 
 func Authorize(templates *template.Template, config Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		data := loginViewData{
-			ClientID:        r.URL.Query().Get("client_id"),
-			RedirectURI:     r.URL.Query().Get("redirect_uri"),
-			Scope:           r.URL.Query().Get("scope"),
-			State:           r.URL.Query().Get("state"),
-			Challenge:       r.URL.Query().Get("code_challenge"),
-			ChallengeMethod: r.URL.Query().Get("code_challenge_method"),
-			QREnabled:       config.QRScan.Enabled,
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		params := r.URL.Query()
+
+		// A pushed request replaces every other parameter
+		pushed := params.Get("request_uri") != ""
+		if pushed {
+			var err error
+			if params, err = readPushedRequest(kvs, params.Get("request_uri"), params.Get("client_id")); err != nil {
+				log.Printf("[Error] Invalid request_uri in authorize call - %v", err)
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
 		}
 
-		svcs := services.ServicesFromContext(r.Context())
+		grant := authCodeDataFromParams(params)
 
-		if !svcs.Authorizer().ValidateClient(data.ClientID, data.RedirectURI) {
-			log.Print("[Error] Invalid client and / or redirect URL in authorize call.")
+		client, ok := authorizeClient(svcs, grant.ClientID, grant.RedirectURI)
+		if !ok {
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 
-		if rtype := r.URL.Query().Get("response_type"); rtype != "code" {
-			log.Print("[Error] Unsupported response_type in authorization request.")
-			redirectAuthError(w, r, data.RedirectURI, kUnsupportedResponseType, data.State)
+		if !pushed && client.RequirePAR {
+			log.Printf("[Error] Client (%s) must push its authorization requests.", client.ID)
+			redirectAuthError(w, r, config, grant, kInvalidRequestError, "pushed authorization request required")
 			return
 		}
 
-		if err := templates.ExecuteTemplate(w, kLoginTemplate, data); err != nil {
-			log.Printf("[Error] Failed to execute 'login' template - %v", err)
-			redirectAuthError(w, r, data.RedirectURI, kServerError, data.State)
+		if errS, desc := checkAuthorizeRequest(config, client, grant, params.Get("response_type")); errS != "" {
+			log.Printf("[Error] Rejected authorization request from client (%s) - %s", client.ID, desc)
+			if !validResponseMode(grant.ResponseMode) {
+				grant.ResponseMode = ""
+			}
+			redirectAuthError(w, r, config, grant, errS, desc)
 			return
 		}
-	}
-}
 
-func Login(config Config) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		svcs := services.ServicesFromContext(r.Context())
-		cid := r.FormValue("cid")
-		data := services.AuthCodeData{
-			UID:             "",
-			RedirectURI:     r.FormValue("redir"),
-			Scope:           r.FormValue("scope"),
-			State:           r.FormValue("state"),
-			Challenge:       r.FormValue("challenge"),
-			ChallengeMethod: r.FormValue("challenge_mode"),
-		}
-
-		if !svcs.Authorizer().ValidateClient(cid, data.RedirectURI) {
-			log.Print("[Error] Invalid client and / or redirect URL in login call.")
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
+		// Someone already signed in to this browser skips the login form
+		if session, ok := sessionsFromContext(r.Context()).current(r, kvs); ok && sessionSatisfies(session, grant.Prompt, params.Get("max_age")) {
+			if _, err := svcs.Users().User(session.UID); err == nil {
+				grant.UID = session.UID
+				grant.AuthTime = session.AuthTime
+				grant.AMR = session.AMR
+				completeAuthorization(w, r, config, svcs, grant)
+				return
+			}
 		}
 
-		user := r.FormValue("user")
-		pwd := r.FormValue("pwd")
-
-		uid, err := svcs.Authorizer().Authenticate(user, pwd)
-		if err != nil {
-			log.Printf("[Error] Authentication failed - %v", err)
-			redirectAuthError(w, r, data.RedirectURI, kAccessDeniedError, data.State)
+		if hasScope(grant.Prompt, kPromptNone) {
+			redirectAuthError(w, r, config, grant, kLoginRequiredError, "user is not signed in")
 			return
 		}
 
-		data.UID = uid
-		code, err := svcs.Authorizer().GenerateAuthorizationRequest(data, config.CodeTTL)
+		rid, err := storeWithRandomKey(kvs, kLoginPendingNamespace, kLoginRequestIDSize, grant, kLoginPendingTTL)
 		if err != nil {
-			log.Printf("[Error] Failed to generate authorization code - %v", err)
-			redirectAuthError(w, r, data.RedirectURI, kServerError, data.State)
+			log.Printf("[Error] Failed to store login request - %v", err)
+			redirectAuthError(w, r, config, grant, kServerError, "")
 			return
 		}
 
-		redirectAuthSuccess(w, r, data.RedirectURI, code, data.State)
+		data := loginViewData{
+			RequestID:  rid,
+			ClientName: client.Name,
+			ClientLogo: client.LogoURI,
+			QREnabled:  config.QRScan.Enabled,
+			QRRefresh:  int64(config.QRScan.TTL.Seconds()),
+			CSRFField:  web.CSRFTemplateField(r),
+		}
+
+		if data.QREnabled {
+			rid, err := startQRRequest(kvs, grant, config.QRScan.RequestTTL)
+			if err != nil {
+				log.Printf("[Error] Failed to start QR login request - %v", err)
+				data.QREnabled = false
+			}
+
+			data.QRRequestID = rid
+		}
+
+		if err := templates.ExecuteTemplate(w, kLoginTemplate, data); err != nil {
+			log.Printf("[Error] Failed to execute 'login' template - %v", err)
+			redirectAuthError(w, r, config, grant, kServerError, "")
+			return
+		}
 	}
 }
 
-func Token(config Config) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "https://www.bing.com", http.StatusFound)
+// authCodeDataFromParams collects the authorization request parameters
+// (RFC 6749, Section 4.1.1 plus the PKCE and OpenID Connect additions).
+func authCodeDataFromParams(params url.Values) services.AuthCodeData {
+	return services.AuthCodeData{
+		ClientID:        params.Get("client_id"),
+		RedirectURI:     params.Get("redirect_uri"),
+		Scope:           params.Get("scope"),
+		State:           params.Get("state"),
+		Challenge:       params.Get("code_challenge"),
+		ChallengeMethod: params.Get("code_challenge_method"),
+		Nonce:           params.Get("nonce"),
+		Prompt:          params.Get("prompt"),
+		ResponseMode:    params.Get("response_mode"),
 	}
 }
 
-/**
- * OAuth2 callback redirection helpers
- **/
+// authorizeClient looks up the client behind an authorization request. When
+// the client or redirect URI is bad there is nowhere safe to send an error.
+func authorizeClient(svcs services.Services, cid, redirectURI string) (services.Client, bool) {
+	if !svcs.Authorizer().ValidateClient(cid, redirectURI) {
+		log.Print("[Error] Invalid client and / or redirect URL in authorize call.")
+		return services.Client{}, false
+	}
 
-func redirectAuthSuccess(w http.ResponseWriter, r *http.Request, redir, code, state string) {
-	http.Redirect(w, r, fmt.Sprintf("%s?code=%s&state=%s", redir, code, state), http.StatusFound)
+	client, err := svcs.Clients().Client(cid)
+	if err != nil {
+		log.Printf("[Error] Client lookup failed in authorize call - %v", err)
+		return services.Client{}, false
+	}
+
+	return client, true
 }
 
-func redirectAuthError(w http.ResponseWriter, r *http.Request, redir, errS, state string) {
-	http.Redirect(w, r, fmt.Sprintf("%s?error=%s&state=%s", redir, errS, state), http.StatusFound)
+// checkAuthorizeRequest validates everything in an authorization request
+// besides the client and redirect URI. On failure it returns an RFC 6749
+// error code and description.
+func checkAuthorizeRequest(config Config, client services.Client, grant services.AuthCodeData, responseType string) (string, string) {
+	if !validResponseMode(grant.ResponseMode) {
+		return kInvalidRequestError, "unsupported response_mode"
+	}
+
+	if responseType != kResponseTypeCode {
+		return kUnsupportedResponseType, "only response_type=code is supported"
+	}
+
+	if !validChallengeMethod(grant.ChallengeMethod) {
+		return kInvalidRequestError, "unsupported code_challenge_method"
+	}
+
+	if !client.AllowsGrant(kGrantAuthorizationCode) {
+		return kUnauthorizedClientError, "client is not registered for the authorization_code grant"
+	}
+
+	if !client.AllowsScope(grant.Scope) {
+		return kInvalidScopeError, "requested scope is not allowed for this client"
+	}
+
+	if hasScope(grant.Scope, kScopeOpenID) && !config.servesOpenID() {
+		return kInvalidScopeError, "openid is not served by this issuer"
+	}
+
+	return "", ""
 }
 
-/**
- * TODO: Remove
- * This is just for playing with the QR Code generator
- **/
-/*
-func DoThing(ttl time.Duration) func(w http.ResponseWriter, r *http.Request) {
+// Login checks the credentials posted from the login form against the
+// authorization request Authorize stored under 'rid'. Each request answers a
+// single attempt; a failure goes back to the client.
+func Login(config Config) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		ts := r.URL.Query().Get("ts")
-		token := r.URL.Query().Get("tk")
-		h := r.URL.Query().Get("h")
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
 
-		tsSecs, err := strconv.ParseInt(ts, 10, 64)
-		if err != nil {
-			log.Printf("[Error] Timestamp parse failure - %v", err)
+		value, err := kvs.ReadAndRemove(kLoginPendingNamespace, r.PostFormValue("rid"))
+		data, ok := value.(services.AuthCodeData)
+		if err != nil || !ok {
+			log.Print("[Error] Unknown or expired login request.")
 			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 			return
 		}
 
-		if time.Now().Sub(time.Unix(tsSecs, 0)) > ttl {
-			log.Printf("[Error] Token expired")
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-			return
-		}
+		user := r.FormValue("user")
+		pwd := r.FormValue("pwd")
 
-		svcs := services.ServicesFromContext(r.Context())
-		if svcs == nil {
-			log.Print("[Error] Failed to acquire active services")
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		limiter := loginLimiterFromContext(r.Context())
+		if limiter.locked(r, user) {
+			redirectAuthError(w, r, config, data, kAccessDeniedError, kLockedOutDescription)
 			return
 		}
 
-		key, err := svcs.Ephemeral().KeyValues().ReadAndRemove("qrc", token)
+		uid, err := svcs.Authorizer().Authenticate(user, pwd)
 		if err != nil {
-			log.Printf("[Error] Failed to fetch key associated with token (%s) - %v", token, err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			log.Printf("[Error] Authentication failed - %v", err)
+			limiter.failed(r, user)
+			redirectAuthError(w, r, config, data, kAccessDeniedError, "invalid username or password")
 			return
 		}
 
-		hm := hmac.New(sha256.New, []byte(key.(string)))
-		hm.Write([]byte(ts))
-		hm.Write([]byte(token))
-		computedH := hm.Sum(nil)
+		data.UID = uid
+		data.AuthTime = time.Now()
+		data.AMR = []string{kAMRPassword}
 
-		expectedH, err := hex.DecodeString(h)
-		if err != nil {
-			log.Printf("[Error] Timestamp parse failure - %v", err)
-			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		if user, err := svcs.Users().User(uid); err == nil && user.HasTOTP() {
+			startSecondFactor(w, r, config, kvs, data)
 			return
 		}
 
-		w.Header().Set("Content-Type", "text/plain")
-		fmt.Fprintf(w, "QR Code Scanned:\n")
-		fmt.Fprintf(w, "  => Timestamp: %v (%s)\n", time.Unix(tsSecs, 0), ts)
-		fmt.Fprintf(w, "  => Token: %s\n", token)
-		fmt.Fprintf(w, "  => Hash: %s\n", h)
-		fmt.Fprintf(w, "  => Verified? %v\n", hmac.Equal(computedH, expectedH))
+		finishLogin(w, r, config, svcs, data)
 	}
 }
-*/
@@ -0,0 +1,130 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestCheckAuthorizeRequestOpenID(t *testing.T) {
+	config := testConfig()
+	client := services.Client{ID: "app", Type: services.ClientTypePublic}
+	grant := services.AuthCodeData{ClientID: "app", Scope: "openid email"}
+
+	errS, _ := checkAuthorizeRequest(config, client, grant, kResponseTypeCode)
+	test.Expect(t, kInvalidScopeError, errS, "no openid under HS256")
+
+	grant.Scope = "email"
+	errS, _ = checkAuthorizeRequest(config, client, grant, kResponseTypeCode)
+	test.Expect(t, "", errS, "other scopes are fine under HS256")
+
+	config.Signing.Algorithm = "ES256"
+	grant.Scope = "openid email"
+	errS, _ = checkAuthorizeRequest(config, client, grant, kResponseTypeCode)
+	test.Expect(t, "", errS, "openid with an asymmetric key")
+
+	_, err := testMinter(t, testConfig()).MintIDToken(grant, "token")
+	test.SpecificError(t, err, kIDTokenKeyError, "HS256 minter refuses ID tokens")
+}
+
+func TestLoginUsesStoredRequest(t *testing.T) {
+	config := testConfig()
+	svcs, kvs := testServices(services.Client{
+		ID:           "app",
+		Type:         services.ClientTypePublic,
+		RedirectURIs: []string{"https://app.example/cb"},
+		GrantTypes:   []string{kGrantAuthorizationCode},
+		Scopes:       []string{"email"},
+	})
+	sessions := newSessionManager(config)
+	templates := template.Must(template.ParseFS(os.DirFS("../../../views/auth"), "*.html"))
+
+	user, err := services.NewUser("dude@example.com", "abides")
+	test.NoError(t, err, "creating user")
+	withTestUsers(svcs, kvs, user)
+
+	withContext := func(r *http.Request) *http.Request {
+		ctx := context.WithValue(r.Context(), services.ServicesContextKey, svcs)
+		return r.WithContext(context.WithValue(ctx, kSessionContextKey, sessions))
+	}
+	login := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Login(config)(w, withContext(formRequest(svcs, "/auth/login", form)))
+		return w
+	}
+
+	query := url.Values{
+		"client_id":    {"app"},
+		"redirect_uri": {"https://app.example/cb"},
+		"scope":        {"email"},
+		"state":        {"s1"},
+	}
+	w := httptest.NewRecorder()
+	Authorize(templates, config)(w, withContext(httptest.NewRequest(http.MethodGet, "/auth/authorize?"+query.Encode()+"&response_type=code", nil)))
+	test.Expect(t, http.StatusOK, w.Code, "login page is shown")
+	test.Expect(t, false, strings.Contains(w.Body.String(), `name="scope"`), "request is not in the form")
+
+	match := regexp.MustCompile(`name="rid" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	test.Require(t, len(match) == 2, "login form carries the request ID")
+	rid := match[1]
+
+	// Whatever else the browser posts is ignored
+	w = login(url.Values{
+		"rid":           {rid},
+		"user":          {"dude@example.com"},
+		"pwd":           {"abides"},
+		"cid":           {"app"},
+		"redir":         {"https://evil.example/cb"},
+		"scope":         {"email admin"},
+		"response_mode": {"fragment"},
+	})
+	test.Expect(t, http.StatusSeeOther, w.Code, "login goes on to consent")
+
+	target, err := url.Parse(w.Header().Get("Location"))
+	test.NoError(t, err, "parsing consent redirect")
+	value, err := kvs.Read(kConsentPendingNamespace, target.Query().Get("rid"))
+	test.NoError(t, err, "reading consent request")
+	grant := value.(services.AuthCodeData)
+	test.Expect(t, user.ID, grant.UID, "grant is for the signed in user")
+	test.Expect(t, "https://app.example/cb", grant.RedirectURI, "stored redirect URI")
+	test.Expect(t, "email", grant.Scope, "stored scope")
+	test.Expect(t, "", grant.ResponseMode, "stored response mode")
+	test.Expect(t, "s1", grant.State, "stored state")
+
+	w = login(url.Values{"rid": {rid}, "user": {"dude@example.com"}, "pwd": {"abides"}})
+	test.Expect(t, http.StatusBadRequest, w.Code, "a login request answers once")
+
+	w = login(url.Values{"user": {"dude@example.com"}, "pwd": {"abides"}, "cid": {"app"}, "redir": {"https://app.example/cb"}})
+	test.Expect(t, http.StatusBadRequest, w.Code, "form fields alone are refused")
+}
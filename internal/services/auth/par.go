@@ -0,0 +1,157 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kPARRoute = "/par"
+
+	kRequestURIPrefix = "urn:ietf:params:oauth:request_uri:"
+	kRequestURISize   = 32
+
+	kPushedRequestNamespace = "par_request"
+)
+
+var (
+	kUnknownRequestURIError = errors.New("unknown or expired request_uri")
+	kRequestURIClientError  = errors.New("request_uri was pushed by another client")
+
+	// Parameters that authenticate the client at the PAR endpoint rather than
+	// being part of the authorization request
+	kClientAuthParams = []string{"client_secret", "client_assertion", "client_assertion_type"}
+)
+
+// The parameters of a pushed authorization request, kept until the browser
+// arrives at the authorization endpoint with the request_uri.
+type pushedRequest struct {
+	ClientID string
+	Params   url.Values
+}
+
+type pushedAuthorizationResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int64  `json:"expires_in"`
+}
+
+// PushedAuthorization accepts an authorization request straight from the
+// client (RFC 9126). The client authenticates as it would at the token
+// endpoint, the request is validated like Authorize would and the client gets
+// back a single use request_uri to send the browser with instead.
+func PushedAuthorization(config Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if limiter := loginLimiterFromContext(r.Context()); limiter.locked(r, tokenRequestClientID(r)) {
+			limiter.writeLockedOut(w)
+			return
+		}
+
+		svcs := services.ServicesFromContext(r.Context())
+
+		client, err := requestClient(r, svcs)
+		if err != nil {
+			log.Printf("[Error] Client authentication failed for pushed authorization request - %v", err)
+			writeClientAuthError(w, r, err)
+			return
+		}
+
+		params := url.Values{}
+		for name, values := range r.PostForm {
+			params[name] = values
+		}
+		for _, name := range kClientAuthParams {
+			params.Del(name)
+		}
+
+		if params.Has("request_uri") {
+			writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "request_uri is not allowed in a pushed request")
+			return
+		}
+
+		// Basic authentication doesn't need client_id in the body, but the
+		// stored request has to name the client like any other
+		if cid := params.Get("client_id"); cid != "" && cid != client.ID {
+			writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "client_id does not match the authenticated client")
+			return
+		}
+		params.Set("client_id", client.ID)
+
+		grant := authCodeDataFromParams(params)
+		if !svcs.Authorizer().ValidateClient(client.ID, grant.RedirectURI) {
+			log.Printf("[Error] Client (%s) pushed a request with an unregistered redirect URI.", client.ID)
+			writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "invalid redirect_uri")
+			return
+		}
+
+		if errS, desc := checkAuthorizeRequest(config, client, grant, params.Get("response_type")); errS != "" {
+			log.Printf("[Error] Rejected pushed authorization request from client (%s) - %s", client.ID, desc)
+			writeTokenError(w, http.StatusBadRequest, errS, desc)
+			return
+		}
+
+		kvs := svcs.Ephemeral().KeyValues()
+		key, err := storeWithRandomKey(kvs, kPushedRequestNamespace, kRequestURISize, pushedRequest{ClientID: client.ID, Params: params}, config.PAR.TTL)
+		if err != nil {
+			log.Printf("[Error] Failed to store pushed authorization request - %v", err)
+			writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, pushedAuthorizationResponse{
+			RequestURI: kRequestURIPrefix + key,
+			ExpiresIn:  int64(config.PAR.TTL.Seconds()),
+		})
+	}
+}
+
+// readPushedRequest swaps a request_uri for the parameters pushed with it. The
+// request_uri can only be used once, and only by the client that pushed it.
+func readPushedRequest(kvs services.KeyValueStore, requestURI, cid string) (url.Values, error) {
+	key, ok := strings.CutPrefix(requestURI, kRequestURIPrefix)
+	if !ok || key == "" {
+		return nil, kUnknownRequestURIError
+	}
+
+	value, err := kvs.ReadAndRemove(kPushedRequestNamespace, key)
+	if err != nil {
+		return nil, kUnknownRequestURIError
+	}
+
+	req, ok := value.(pushedRequest)
+	if !ok {
+		return nil, kUnknownRequestURIError
+	}
+
+	if req.ClientID != cid {
+		return nil, kRequestURIClientError
+	}
+
+	return req.Params, nil
+}
@@ -0,0 +1,54 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestReadPushedRequest(t *testing.T) {
+	kvs := services.NewMemoryStore(context.Background())
+	params := url.Values{"client_id": {"app"}, "scope": {"openid"}}
+
+	kvs.Set(kPushedRequestNamespace, "one", pushedRequest{ClientID: "app", Params: params}, time.Minute)
+	kvs.Set(kPushedRequestNamespace, "two", pushedRequest{ClientID: "app", Params: params}, time.Minute)
+
+	found, err := readPushedRequest(kvs, kRequestURIPrefix+"one", "app")
+	test.NoError(t, err, "pushed request is found")
+	test.Expect(t, "openid", found.Get("scope"), "pushed parameters are returned")
+
+	_, err = readPushedRequest(kvs, kRequestURIPrefix+"one", "app")
+	test.SpecificError(t, err, kUnknownRequestURIError, "request_uri is single use")
+
+	_, err = readPushedRequest(kvs, "one", "app")
+	test.SpecificError(t, err, kUnknownRequestURIError, "request_uri needs the URN prefix")
+
+	_, err = readPushedRequest(kvs, kRequestURIPrefix+"two", "other")
+	test.SpecificError(t, err, kRequestURIClientError, "only the pushing client can use it")
+}
@@ -0,0 +1,105 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+)
+
+const (
+	kChallengeMethodPlain = "plain"
+	kChallengeMethodS256  = "S256"
+
+	// RFC 7636 (Section 4.1) verifier length limits
+	kMinVerifierLength = 43
+	kMaxVerifierLength = 128
+)
+
+var (
+	kMissingVerifierError     = errors.New("missing code_verifier")
+	kUnexpectedVerifierError  = errors.New("code_verifier sent without a code_challenge")
+	kInvalidVerifierError     = errors.New("malformed code_verifier")
+	kUnknownChallengeMethod   = errors.New("unsupported code_challenge_method")
+	kChallengeMismatchedError = errors.New("code_verifier does not match code_challenge")
+)
+
+func validChallengeMethod(method string) bool {
+	return method == "" || method == kChallengeMethodPlain || method == kChallengeMethodS256
+}
+
+// verifyCodeChallenge checks a token request's code_verifier against the challenge
+// captured during authorization. No challenge means PKCE was not used, in which case
+// no verifier is allowed either.
+func verifyCodeChallenge(challenge, method, verifier string) error {
+	if challenge == "" {
+		if verifier != "" {
+			return kUnexpectedVerifierError
+		}
+		return nil
+	}
+
+	if verifier == "" {
+		return kMissingVerifierError
+	}
+
+	if !validVerifier(verifier) {
+		return kInvalidVerifierError
+	}
+
+	var computed string
+	switch method {
+	case "", kChallengeMethodPlain:
+		computed = verifier
+	case kChallengeMethodS256:
+		sum := sha256.Sum256([]byte(verifier))
+		computed = base64.RawURLEncoding.EncodeToString(sum[:])
+	default:
+		return kUnknownChallengeMethod
+	}
+
+	if subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) != 1 {
+		return kChallengeMismatchedError
+	}
+
+	return nil
+}
+
+func validVerifier(verifier string) bool {
+	if len(verifier) < kMinVerifierLength || len(verifier) > kMaxVerifierLength {
+		return false
+	}
+
+	for _, c := range verifier {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,71 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+// Test vector from RFC 7636 (Appendix B)
+const (
+	kTestVerifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	kTestChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+)
+
+func TestPKCES256(t *testing.T) {
+	err := verifyCodeChallenge(kTestChallenge, kChallengeMethodS256, kTestVerifier)
+	test.NoError(t, err, "S256 verifier should match challenge")
+
+	err = verifyCodeChallenge(kTestChallenge, kChallengeMethodS256, strings.ToUpper(kTestVerifier))
+	test.SpecificError(t, err, kChallengeMismatchedError, "altered verifier should not match")
+}
+
+func TestPKCEPlain(t *testing.T) {
+	err := verifyCodeChallenge(kTestVerifier, kChallengeMethodPlain, kTestVerifier)
+	test.NoError(t, err, "plain verifier should match challenge")
+
+	err = verifyCodeChallenge(kTestVerifier, "", kTestVerifier)
+	test.NoError(t, err, "missing method should default to plain")
+
+	err = verifyCodeChallenge(kTestChallenge, kChallengeMethodPlain, kTestVerifier)
+	test.SpecificError(t, err, kChallengeMismatchedError, "plain verifier should not match S256 challenge")
+}
+
+func TestPKCEMissingPieces(t *testing.T) {
+	test.NoError(t, verifyCodeChallenge("", "", ""), "no challenge and no verifier is allowed")
+
+	err := verifyCodeChallenge("", "", kTestVerifier)
+	test.SpecificError(t, err, kUnexpectedVerifierError, "verifier without challenge")
+
+	err = verifyCodeChallenge(kTestChallenge, kChallengeMethodS256, "")
+	test.SpecificError(t, err, kMissingVerifierError, "challenge without verifier")
+
+	err = verifyCodeChallenge(kTestChallenge, kChallengeMethodS256, "too-short")
+	test.SpecificError(t, err, kInvalidVerifierError, "short verifier")
+
+	err = verifyCodeChallenge(kTestChallenge, "S512", kTestVerifier)
+	test.SpecificError(t, err, kUnknownChallengeMethod, "unknown method")
+}
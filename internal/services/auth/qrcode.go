@@ -23,9 +23,11 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	qrcode "github.com/skip2/go-qrcode"
 	"shiftylogic.dev/site-plat/internal/services"
@@ -34,12 +36,87 @@ import (
 const (
 	kQRImageSize              = 512
 	kQRErrorCorrectionQuality = qrcode.Low
+
+	kQRScanRoute   = "/qrscan"
+	kQRStatusRoute = "/qrstatus"
+	kQRLoginRoute  = "/qrlogin"
+
+	kQRRequestIDSize = 20
+
+	kQRRequestNamespace  = "qr_request"
+	kQRAnsweredNamespace = "qr_answered"
+
+	// States of requests waiting on a user elsewhere (QR scans, device codes)
+	kStatusPending  = "pending"
+	kStatusApproved = "approved"
+	kStatusDenied   = "denied"
+	kStatusExpired  = "expired"
+
+	kActionApprove = "approve"
+	kActionDeny    = "deny"
+
+	// Authentication method reported in amr for QR logins
+	kAMRQRCode = "qr"
 )
 
+var (
+	kQRRequestNotFoundError = errors.New("QR login request not found or expired")
+	kQRRequestAnsweredError = errors.New("QR login request already answered")
+)
+
+// A login page waiting on a QR code scan. Grant carries the authorization
+// request the page was rendered for; the scanning device fills in the user.
+type qrRequest struct {
+	Grant  services.AuthCodeData
+	Status string
+}
+
+type qrStatusResponse struct {
+	Status string `json:"status"`
+}
+
+type qrScanResponse struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+	Status   string `json:"status"`
+}
+
+// startQRRequest records the authorization request behind a login page so a
+// QR code scan can complete it later. The returned ID is only given to the
+// browser showing the page.
+func startQRRequest(kvs services.KeyValueStore, data services.AuthCodeData, ttl time.Duration) (string, error) {
+	return storeWithRandomKey(kvs, kQRRequestNamespace, kQRRequestIDSize, qrRequest{Grant: data, Status: kStatusPending}, ttl)
+}
+
+func readQRRequest(kvs services.KeyValueStore, rid string) (qrRequest, error) {
+	value, err := kvs.Read(kQRRequestNamespace, rid)
+	if err != nil {
+		return qrRequest{}, kQRRequestNotFoundError
+	}
+
+	req, ok := value.(qrRequest)
+	if !ok {
+		return qrRequest{}, kQRRequestNotFoundError
+	}
+
+	return req, nil
+}
+
+// QRGenerator renders a QR code for the pending request identified by 'rid'.
+// Every call produces a fresh code, so the login page can refresh the image
+// before qr.TTL runs out.
 func QRGenerator(qr QRScanConfig) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		svcs := services.ServicesFromContext(r.Context())
-		ts, token, hash, err := svcs.Authorizer().GenerateQRRequest(qr.TTL)
+		rid := r.URL.Query().Get("rid")
+
+		if _, err := readQRRequest(svcs.Ephemeral().KeyValues(), rid); err != nil {
+			log.Printf("[Error] QR code requested for unknown login request - %v", err)
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+
+		ts, token, hash, err := svcs.Authorizer().GenerateQRRequest(rid, qr.TTL)
 		if err != nil {
 			log.Printf("[Error] Failed to generate QR request - %v", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -47,7 +124,7 @@ func QRGenerator(qr QRScanConfig) func(http.ResponseWriter, *http.Request) {
 		}
 
 		code, err := qrcode.New(
-			fmt.Sprintf("%s?ts=%s&tk=%s&h=%x", qr.Prefix, ts, token, hash),
+			fmt.Sprintf("%s?ts=%s&tk=%s&h=%s", qr.Prefix, ts, token, hash),
 			kQRErrorCorrectionQuality,
 		)
 		if err != nil {
@@ -64,6 +141,156 @@ func QRGenerator(qr QRScanConfig) func(http.ResponseWriter, *http.Request) {
 		}
 
 		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
 		w.Write(png)
 	}
 }
+
+// isQRApprover reports whether tokens issued to cid may answer QR sign-ins.
+func isQRApprover(qr QRScanConfig, cid string) bool {
+	for _, approver := range qr.ApproverClients {
+		if cid != "" && cid == approver {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QRScan is called by a signed-in device (it presents its own access token,
+// checked by RequireAccessToken) with the ts / tk / h values from a scanned
+// code. Approving hands the token's user a sign-in to the waiting page, so the
+// token must belong to a user, carry the qr_approve scope and have been issued
+// to one of qr.ApproverClients. GET describes the waiting request so the user
+// can check it; POST with action=approve|deny answers it. A request can only
+// be answered once.
+func QRScan(qr QRScanConfig) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		claims := AccessTokenFromContext(r.Context())
+
+		if !hasScope(claims.Scope, kScopeQRApprove) {
+			writeBearerError(w, http.StatusForbidden, kInsufficientScopeError, kScopeQRApprove+" scope required")
+			return
+		}
+
+		if !isQRApprover(qr, claims.ClientID) {
+			log.Printf("[Error] QR code scanned with a token for a non-approver client (%s).", claims.ClientID)
+			writeBearerError(w, http.StatusForbidden, kInsufficientScopeError, "client may not approve QR sign-ins")
+			return
+		}
+
+		if _, err := svcs.Users().User(claims.Subject); err != nil {
+			log.Printf("[Error] QR code scanned with a token for a non-user (%s) - %v", claims.Subject, err)
+			writeBearerError(w, http.StatusForbidden, kInsufficientScopeError, "token does not belong to a user")
+			return
+		}
+
+		rid, err := svcs.Authorizer().VerifyQRRequest(r.FormValue("ts"), r.FormValue("tk"), r.FormValue("h"), qr.TTL)
+		if err != nil {
+			log.Printf("[Error] QR code verification failed - %v", err)
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidRequestError, Description: "invalid or expired QR code"})
+			return
+		}
+
+		req, err := readQRRequest(kvs, rid)
+		if err != nil {
+			log.Printf("[Error] QR code scanned for a dead login request - %v", err)
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidRequestError, Description: err.Error()})
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			writeJSON(w, http.StatusOK, qrScanResponse{ClientID: req.Grant.ClientID, Scope: req.Grant.Scope, Status: req.Status})
+			return
+		}
+
+		switch r.PostFormValue("action") {
+		case kActionApprove:
+			req.Status = kStatusApproved
+			req.Grant.UID = claims.Subject
+			req.Grant.AuthTime = time.Now()
+			req.Grant.AMR = []string{kAMRQRCode}
+		case kActionDeny:
+			req.Status = kStatusDenied
+		default:
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidRequestError, Description: "action must be approve or deny"})
+			return
+		}
+
+		if err := kvs.CheckAndSet(kQRAnsweredNamespace, rid, claims.Subject, qr.RequestTTL); err != nil {
+			log.Printf("[Error] Duplicate answer for QR login request - %v", err)
+			writeJSON(w, http.StatusConflict, errorResponse{Error: kInvalidRequestError, Description: kQRRequestAnsweredError.Error()})
+			return
+		}
+
+		// The login page only has to notice the answer and follow through, so the
+		// request doesn't need to outlive another QR code lifetime.
+		if err := kvs.Set(kQRRequestNamespace, rid, req, qr.TTL); err != nil {
+			log.Printf("[Error] Failed to record QR login answer - %v", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: kServerError})
+			return
+		}
+
+		trackPending(kvs, req.Grant.UID, kQRRequestNamespace, rid, qr.TTL)
+		writeJSON(w, http.StatusOK, qrStatusResponse{Status: req.Status})
+	}
+}
+
+// QRStatus is polled by the login page while it waits for a scan.
+func QRStatus() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+
+		req, err := readQRRequest(svcs.Ephemeral().KeyValues(), r.URL.Query().Get("rid"))
+		if err != nil {
+			writeJSON(w, http.StatusOK, qrStatusResponse{Status: kStatusExpired})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, qrStatusResponse{Status: req.Status})
+	}
+}
+
+// QRLogin finishes an answered request: the login page navigates here and is
+// sent back to the client with an authorization code (or access_denied), just
+// like a password login.
+func QRLogin(config Config) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		rid := r.URL.Query().Get("rid")
+
+		req, err := readQRRequest(kvs, rid)
+		if err != nil || req.Status == kStatusPending {
+			log.Print("[Error] QR login completion for an unknown or unanswered request.")
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := kvs.ReadAndRemove(kQRRequestNamespace, rid); err != nil {
+			log.Printf("[Error] QR login request already completed - %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		data := req.Grant
+		if req.Status != kStatusApproved {
+			redirectAuthError(w, r, config, data, kAccessDeniedError, "the user denied the request")
+			return
+		}
+
+		finishLogin(w, r, config, svcs, data)
+	}
+}
+
+// qrScanPrefix is the URL encoded into QR codes. Unless configured otherwise
+// it is this service's own scan endpoint.
+func qrScanPrefix(config Config) string {
+	if config.QRScan.Prefix != "" || config.Issuer == "" {
+		return config.QRScan.Prefix
+	}
+
+	return endpointBase(config) + kQRScanRoute
+}
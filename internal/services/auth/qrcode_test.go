@@ -0,0 +1,85 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestQRScan(t *testing.T) {
+	config := testConfig().QRScan
+	config.ApproverClients = []string{"phone"}
+	svcs, kvs := testServices(services.Client{ID: "app", Type: services.ClientTypePublic})
+	withTestUsers(svcs, kvs, services.User{ID: "1", Username: "dude"})
+
+	grant := services.AuthCodeData{ClientID: "app", Scope: "read"}
+	pending := func() string {
+		rid, err := startQRRequest(kvs, grant, time.Minute)
+		test.NoError(t, err, "starting QR request")
+		return rid
+	}
+	scan := func(claims *AccessTokenClaims, rid, action string) int {
+		r := formRequest(svcs, "/auth/qrscan", url.Values{"ts": {"0"}, "tk": {rid}, "h": {"h"}, "action": {action}})
+		r = r.WithContext(context.WithValue(r.Context(), kAccessTokenContextKey, claims))
+
+		w := httptest.NewRecorder()
+		QRScan(config)(w, r)
+		return w.Code
+	}
+	token := func(sub, cid, scope string) *AccessTokenClaims {
+		claims := &AccessTokenClaims{ClientID: cid, Scope: scope}
+		claims.Subject = sub
+		return claims
+	}
+
+	rid := pending()
+	test.Expect(t, http.StatusForbidden, scan(token("1", "phone", "read"), rid, kActionApprove), "token without qr_approve")
+	test.Expect(t, http.StatusForbidden, scan(token("phone", "phone", kScopeQRApprove), rid, kActionApprove), "client credentials token")
+	test.Expect(t, http.StatusForbidden, scan(token("1", "app", kScopeQRApprove), rid, kActionApprove), "token for another client")
+	test.Expect(t, http.StatusForbidden, scan(token("1", "", kScopeQRApprove), rid, kActionApprove), "token without a client")
+	req, err := readQRRequest(kvs, rid)
+	test.NoError(t, err, "request survives wrong tokens")
+	test.Expect(t, kStatusPending, req.Status, "wrong tokens don't answer")
+
+	test.Expect(t, http.StatusOK, scan(token("1", "phone", kScopeQRApprove), rid, kActionApprove), "user approves")
+	req, err = readQRRequest(kvs, rid)
+	test.NoError(t, err, "approved request is kept for the login page")
+	test.Expect(t, kStatusApproved, req.Status, "request is approved")
+	test.Expect(t, "1", req.Grant.UID, "approving user is recorded")
+	test.Expect(t, http.StatusConflict, scan(token("1", "phone", kScopeQRApprove), rid, kActionDeny), "only answered once")
+
+	rid = pending()
+	test.Expect(t, http.StatusOK, scan(token("1", "phone", kScopeQRApprove), rid, kActionDeny), "user rejects")
+	req, err = readQRRequest(kvs, rid)
+	test.NoError(t, err, "rejected request is kept for the login page")
+	test.Expect(t, kStatusDenied, req.Status, "request is denied")
+	test.Expect(t, "", req.Grant.UID, "no user on a rejected request")
+}
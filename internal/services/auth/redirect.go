@@ -0,0 +1,146 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	// OAuth 2.0 Multiple Response Type Encoding Practices / Form Post Response Mode
+	kResponseModeQuery    = "query"
+	kResponseModeFragment = "fragment"
+	kResponseModeFormPost = "form_post"
+)
+
+var (
+	kResponseModes = []string{kResponseModeQuery, kResponseModeFragment, kResponseModeFormPost}
+
+	// Served for response_mode=form_post; the browser posts the response to
+	// the client as soon as it loads
+	kFormPostTemplate = template.Must(template.New("form_post").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="utf-8">
+    <title>Signing In</title>
+</head>
+<body onload="document.forms[0].submit()">
+  <form method="post" action="{{.Action}}">
+    {{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+    {{end}}<noscript><button type="submit">Continue</button></noscript>
+  </form>
+</body>
+</html>
+`))
+)
+
+type formPostViewData struct {
+	Action string
+	Params map[string]string
+}
+
+/**
+ * OAuth2 callback redirection helpers
+ **/
+
+func redirectAuthSuccess(w http.ResponseWriter, r *http.Request, config Config, data services.AuthCodeData, code string) {
+	writeAuthResponse(w, r, config, data, url.Values{"code": {code}})
+}
+
+func redirectAuthError(w http.ResponseWriter, r *http.Request, config Config, data services.AuthCodeData, errS, desc string) {
+	params := url.Values{"error": {errS}}
+	if desc != "" {
+		params.Set("error_description", desc)
+	}
+
+	writeAuthResponse(w, r, config, data, params)
+}
+
+// writeAuthResponse sends an authorization response back to the client in
+// the requested response mode. Every response carries the state (when the
+// request had one) and the issuer (RFC 9207) so the client can tell which
+// server is answering.
+func writeAuthResponse(w http.ResponseWriter, r *http.Request, config Config, data services.AuthCodeData, params url.Values) {
+	if data.State != "" {
+		params.Set("state", data.State)
+	}
+	if config.Issuer != "" {
+		params.Set("iss", config.Issuer)
+	}
+
+	target, err := url.Parse(data.RedirectURI)
+	if err != nil {
+		log.Printf("[Error] Unusable redirect URI (%s) - %v", data.RedirectURI, err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch data.ResponseMode {
+	case kResponseModeFormPost:
+		view := formPostViewData{Action: target.String(), Params: make(map[string]string)}
+		for name := range params {
+			view.Params[name] = params.Get(name)
+		}
+
+		w.Header().Set("Content-Type", "text/html;charset=UTF-8")
+		if err := kFormPostTemplate.Execute(w, view); err != nil {
+			log.Printf("[Error] Failed to execute 'form_post' template - %v", err)
+		}
+
+	case kResponseModeFragment:
+		// Redirect URIs can't have a fragment of their own (RFC 6749, 3.1.2)
+		target.Fragment = ""
+		target.RawFragment = ""
+		http.Redirect(w, r, target.String()+"#"+params.Encode(), http.StatusFound)
+
+	default:
+		// Keep whatever query the registered redirect URI already has
+		query := target.Query()
+		for name, values := range params {
+			query[name] = values
+		}
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	}
+}
+
+func validResponseMode(mode string) bool {
+	if mode == "" {
+		return true
+	}
+
+	for _, m := range kResponseModes {
+		if m == mode {
+			return true
+		}
+	}
+
+	return false
+}
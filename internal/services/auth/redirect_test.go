@@ -0,0 +1,60 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestAuthResponseModes(t *testing.T) {
+	config := Config{Issuer: "https://issuer.example"}
+	data := services.AuthCodeData{RedirectURI: "https://client.example/cb?tenant=a%20b", State: "x&y"}
+
+	respond := func(mode string) *httptest.ResponseRecorder {
+		data.ResponseMode = mode
+		w := httptest.NewRecorder()
+		redirectAuthSuccess(w, httptest.NewRequest(http.MethodPost, "/auth/login", nil), config, data, "c0de")
+		return w
+	}
+
+	w := respond("")
+	test.Expect(t, http.StatusFound, w.Code, "query mode redirects")
+	test.Expect(t,
+		"https://client.example/cb?code=c0de&iss=https%3A%2F%2Fissuer.example&state=x%26y&tenant=a+b",
+		w.Header().Get("Location"), "query keeps the existing parameters and escapes values")
+
+	w = respond(kResponseModeFragment)
+	test.Expect(t,
+		"https://client.example/cb?tenant=a%20b#code=c0de&iss=https%3A%2F%2Fissuer.example&state=x%26y",
+		w.Header().Get("Location"), "fragment mode")
+
+	w = respond(kResponseModeFormPost)
+	test.Expect(t, http.StatusOK, w.Code, "form_post renders a page")
+	test.Require(t, strings.Contains(w.Body.String(), `name="state" value="x&amp;y"`), "form_post escapes values")
+}
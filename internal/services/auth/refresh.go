@@ -0,0 +1,264 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kGrantRefreshToken = "refresh_token"
+
+	kRefreshTokenSize = 48
+	kFamilyIDSize     = 24
+
+	kRefreshTokenNamespace  = "refresh_token"
+	kRefreshFamilyNamespace = "refresh_family"
+	kRefreshUsedNamespace   = "refresh_used"
+)
+
+var (
+	kRefreshFamilyExpiredError = errors.New("refresh token family has expired")
+)
+
+/**
+ *
+ * Refresh tokens are opaque and grouped into families. Every grant that starts
+ * from an authorization code begins a new family and every refresh rotates to
+ * a new token in the same family. Presenting a token that was already rotated
+ * means it leaked, so the whole family is revoked.
+ *
+ **/
+
+type refreshTokenData struct {
+	FamilyID string
+	Grant    services.AuthCodeData
+	IssuedAt time.Time
+	Expires  time.Time
+}
+
+type refreshFamily struct {
+	Expires time.Time
+}
+
+// startRefreshFamily returns the new family's ID and its first refresh token.
+func startRefreshFamily(kvs services.KeyValueStore, grant services.AuthCodeData, config Config) (string, string, error) {
+	family := refreshFamily{Expires: time.Now().Add(config.RefreshFamilyTTL)}
+
+	fid, err := storeWithRandomKey(kvs, kRefreshFamilyNamespace, kFamilyIDSize, family, config.RefreshFamilyTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err := issueRefreshToken(kvs, fid, family, grant, config)
+	if err != nil {
+		return "", "", err
+	}
+
+	return fid, token, nil
+}
+
+func issueRefreshToken(kvs services.KeyValueStore, fid string, family refreshFamily, grant services.AuthCodeData, config Config) (string, error) {
+	// A token never outlives its family
+	ttl := time.Until(family.Expires)
+	if ttl <= 0 {
+		return "", kRefreshFamilyExpiredError
+	}
+	if ttl > config.RefreshTTL {
+		ttl = config.RefreshTTL
+	}
+
+	now := time.Now()
+	data := refreshTokenData{
+		FamilyID: fid,
+		Grant: services.AuthCodeData{
+			UID:      grant.UID,
+			ClientID: grant.ClientID,
+			Scope:    grant.Scope,
+			JKT:      grant.JKT,
+		},
+		IssuedAt: now,
+		Expires:  now.Add(ttl),
+	}
+
+	return storeWithRandomKey(kvs, kRefreshTokenNamespace, kRefreshTokenSize, data, ttl)
+}
+
+// readRefreshToken returns a refresh token along with its family. Tokens whose
+// family has been revoked or has expired are not returned.
+func readRefreshToken(kvs services.KeyValueStore, token string) (refreshTokenData, refreshFamily, error) {
+	value, err := kvs.Read(kRefreshTokenNamespace, token)
+	if err != nil {
+		return refreshTokenData{}, refreshFamily{}, err
+	}
+
+	data := value.(refreshTokenData)
+
+	fvalue, err := kvs.Read(kRefreshFamilyNamespace, data.FamilyID)
+	if err != nil {
+		return refreshTokenData{}, refreshFamily{}, err
+	}
+
+	return data, fvalue.(refreshFamily), nil
+}
+
+// refreshTokenUsed reports whether a token has already been rotated away.
+func refreshTokenUsed(kvs services.KeyValueStore, token string) bool {
+	_, err := kvs.Read(kRefreshUsedNamespace, token)
+	return err == nil
+}
+
+func revokeRefreshFamily(kvs services.KeyValueStore, fid string) {
+	kvs.Remove(kRefreshFamilyNamespace, fid)
+}
+
+func tokenFromRefreshToken(w http.ResponseWriter, r *http.Request, config Config, minter *TokenMinter) {
+	token := r.PostFormValue("refresh_token")
+	scope := r.PostFormValue("scope")
+
+	if token == "" {
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "missing refresh_token")
+		return
+	}
+
+	svcs := services.ServicesFromContext(r.Context())
+	kvs := svcs.Ephemeral().KeyValues()
+
+	client, ok := requestClientForGrant(w, r, svcs, kGrantRefreshToken)
+	if !ok {
+		return
+	}
+
+	data, family, err := readRefreshToken(kvs, token)
+	if err != nil {
+		log.Printf("[Error] Failed to read refresh token - %v", err)
+		// No secret was involved, so this never counts against the client
+		loginLimiterFromContext(r.Context()).failed(r, "")
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "invalid or expired refresh token")
+		return
+	}
+
+	if data.Grant.ClientID != client.ID {
+		log.Print("[Error] Refresh token was not issued to the requesting client.")
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "client_id mismatch")
+		return
+	}
+
+	if refreshTokenUsed(kvs, token) {
+		rejectRefreshReuse(w, kvs, data.FamilyID)
+		return
+	}
+
+	// A bound refresh token is only good with a proof from the same key
+	jkt := dpopKeyFromContext(r.Context())
+	if data.Grant.JKT != "" && data.Grant.JKT != jkt {
+		log.Print("[Error] Refresh token presented without a proof from its DPoP key.")
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "refresh token is bound to a different DPoP key")
+		return
+	}
+
+	// Everything that can reject the request is checked before the token is
+	// spent, so a client can retry a mistake with the same token.
+	if scope != "" && !scopeSubset(scope, data.Grant.Scope) {
+		writeTokenError(w, http.StatusBadRequest, kInvalidScopeError, "scope exceeds original grant")
+		return
+	}
+
+	// Marking the token as used is the atomic step; whoever loses the race
+	// is holding a token that has already been rotated.
+	if err := kvs.CheckAndSet(kRefreshUsedNamespace, token, data.FamilyID, time.Until(family.Expires)); err != nil {
+		rejectRefreshReuse(w, kvs, data.FamilyID)
+		return
+	}
+
+	grant := data.Grant
+	grant.JKT = jkt
+	grant.X5T = clientCertThumbprint(r)
+	if scope != "" {
+		grant.Scope = scope
+	}
+
+	access, _, err := minter.Issue(kvs, grant, data.FamilyID)
+	if err != nil {
+		log.Printf("[Error] Failed to issue access token - %v", err)
+		writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		return
+	}
+
+	// The rotated token keeps the original grant so a narrowed scope on one
+	// refresh does not shrink later ones.
+	refresh, err := issueRefreshToken(kvs, data.FamilyID, family, data.Grant, config)
+	if err != nil {
+		log.Printf("[Error] Failed to rotate refresh token - %v", err)
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "refresh token family has expired")
+		return
+	}
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken:  access,
+		TokenType:    tokenType(grant.JKT),
+		ExpiresIn:    int64(config.TokenTTL.Seconds()),
+		RefreshToken: refresh,
+		Scope:        grant.Scope,
+	})
+}
+
+// rejectRefreshReuse answers a request with a token that was already rotated
+// away. It leaked, so the family it belongs to is revoked.
+func rejectRefreshReuse(w http.ResponseWriter, kvs services.KeyValueStore, fid string) {
+	log.Printf("[Error] Refresh token reuse detected, revoking family (%s)", fid)
+	revokeRefreshFamily(kvs, fid)
+	writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "refresh token has already been used")
+}
+
+// storeWithRandomKey saves value under a freshly generated key, retrying on the
+// (unlikely) event of a collision.
+func storeWithRandomKey(kvs services.KeyValueStore, ns string, size int, value any, ttl time.Duration) (string, error) {
+	return storeWithRandomCode(kvs, ns, size, helpers.AlphaNumeric, value, ttl)
+}
+
+// storeWithRandomCode is storeWithRandomKey with a caller supplied alphabet.
+func storeWithRandomCode(kvs services.KeyValueStore, ns string, size int, chars string, value any, ttl time.Duration) (string, error) {
+	var key string
+	var err error
+
+	for i := 0; i < kTokenGenRetries; i++ {
+		key, err = helpers.GenerateStringSecure(size, chars)
+		if err != nil {
+			return "", err
+		}
+
+		err = kvs.CheckAndSet(ns, key, value, ttl)
+		if err == nil {
+			return key, nil
+		}
+	}
+
+	return "", err
+}
@@ -0,0 +1,77 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestRefreshToken(t *testing.T) {
+	config := testConfig()
+	minter := testMinter(t, config)
+	svcs, kvs := testServices(services.Client{ID: "app", Type: services.ClientTypePublic, GrantTypes: []string{kGrantRefreshToken}})
+
+	_, first, err := startRefreshFamily(kvs, services.AuthCodeData{UID: "dude", ClientID: "app", Scope: "read write"}, config)
+	test.NoError(t, err, "starting refresh family")
+
+	refresh := func(token, scope string) (int, map[string]any) {
+		form := url.Values{"grant_type": {kGrantRefreshToken}, "client_id": {"app"}, "refresh_token": {token}}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+
+		w := httptest.NewRecorder()
+		tokenFromRefreshToken(w, formRequest(svcs, "/auth/token", form), config, minter)
+		return decodeResponse(t, w)
+	}
+
+	status, body := refresh(first, "read admin")
+	test.Expect(t, http.StatusBadRequest, status, "scope beyond the grant")
+	test.Expect(t, kInvalidScopeError, body["error"], "scope beyond the grant")
+
+	status, body = refresh(first, "read")
+	test.Expect(t, http.StatusOK, status, "retry after invalid_scope")
+	test.Expect(t, "read", body["scope"], "narrowed scope")
+
+	second, _ := body["refresh_token"].(string)
+	test.Require(t, second != "" && second != first, "refresh token is rotated")
+
+	status, body = refresh(second, "")
+	test.Expect(t, http.StatusOK, status, "rotated token works")
+	test.Expect(t, "read write", body["scope"], "rotation keeps the original grant")
+
+	third, _ := body["refresh_token"].(string)
+
+	status, body = refresh(first, "")
+	test.Expect(t, http.StatusBadRequest, status, "reused token")
+	test.Expect(t, kInvalidGrantError, body["error"], "reused token")
+
+	status, _ = refresh(third, "")
+	test.Expect(t, http.StatusBadRequest, status, "reuse revokes the family")
+}
@@ -0,0 +1,395 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/web"
+)
+
+const (
+	kRegisterRoute       = "/register"
+	kRegisterClientRoute = "/register/{client_id}"
+
+	kClientIDSize                = 24
+	kClientSecretSize            = 48
+	kRegistrationAccessTokenSize = 48
+
+	// Hashes of registration access tokens, keyed by client ID
+	kRegistrationNamespace = "client_registration"
+
+	// RFC 7591 (Section 3.2.2) error codes
+	kInvalidRedirectURIError    = "invalid_redirect_uri"
+	kInvalidClientMetadataError = "invalid_client_metadata"
+
+	kResponseTypeCode = "code"
+)
+
+// Client metadata as registered (RFC 7591, Section 2)
+type clientMetadata struct {
+	RedirectURIs            []string `json:"redirect_uris,omitempty"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method,omitempty"`
+	GrantTypes              []string `json:"grant_types,omitempty"`
+	ResponseTypes           []string `json:"response_types,omitempty"`
+	ClientName              string   `json:"client_name,omitempty"`
+	LogoURI                 string   `json:"logo_uri,omitempty"`
+	Scope                   string   `json:"scope,omitempty"`
+
+	// RFC 9126, Section 6
+	RequirePushedAuthorizationRequests bool `json:"require_pushed_authorization_requests,omitempty"`
+}
+
+type registrationRequest struct {
+	clientMetadata
+	ClientID string `json:"client_id,omitempty"`
+}
+
+type registrationResponse struct {
+	clientMetadata
+	ClientID              string `json:"client_id"`
+	ClientSecret          string `json:"client_secret,omitempty"`
+	ClientIDIssuedAt      int64  `json:"client_id_issued_at,omitempty"`
+	ClientSecretExpiresAt *int64 `json:"client_secret_expires_at,omitempty"`
+
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri"`
+}
+
+// Register creates a client (RFC 7591). Callers need one of the configured
+// initial access tokens. The response is the only time the client secret and
+// registration access token are ever shown; only their hashes are kept.
+//
+// Clients and their registration access tokens are kept in the data store,
+// which is in memory for now, so registrations do not survive a restart.
+func Register(config Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkInitialAccessToken(r, config.Registration.InitialAccessTokens) {
+			log.Print("[Error] Client registration without a valid initial access token.")
+			writeBearerError(w, http.StatusUnauthorized, kInvalidTokenError, "")
+			return
+		}
+
+		var req registrationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidClientMetadataError, Description: "malformed JSON body"})
+			return
+		}
+
+		client, errS, desc := req.toClient(config)
+		if errS != "" {
+			log.Printf("[Error] Rejected client registration - %s", desc)
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: errS, Description: desc})
+			return
+		}
+
+		resp := registrationResponse{clientMetadata: clientToMetadata(client)}
+
+		var err error
+		if client.IsConfidential() {
+			if resp.ClientSecret, err = helpers.GenerateStringSecure(kClientSecretSize, helpers.AlphaNumeric); err != nil {
+				log.Printf("[Error] Failed to generate client secret - %v", err)
+				writeJSON(w, http.StatusInternalServerError, errorResponse{Error: kServerError})
+				return
+			}
+
+			client.SecretHash = services.HashClientSecret(resp.ClientSecret)
+			noExpiry := int64(0)
+			resp.ClientSecretExpiresAt = &noExpiry
+		}
+
+		if resp.RegistrationAccessToken, err = helpers.GenerateStringSecure(kRegistrationAccessTokenSize, helpers.AlphaNumeric); err != nil {
+			log.Printf("[Error] Failed to generate registration access token - %v", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: kServerError})
+			return
+		}
+
+		svcs := services.ServicesFromContext(r.Context())
+
+		for i := 0; i < kTokenGenRetries; i++ {
+			if client.ID, err = helpers.GenerateStringSecure(kClientIDSize, helpers.AlphaNumeric); err != nil {
+				break
+			}
+
+			if err = svcs.Clients().Register(client); err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			log.Printf("[Error] Failed to register client - %v", err)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: kServerError})
+			return
+		}
+
+		kvs := svcs.Ephemeral().KeyValues()
+		if err := kvs.Set(kRegistrationNamespace, client.ID, services.HashClientSecret(resp.RegistrationAccessToken), services.NoExpiration); err != nil {
+			log.Printf("[Error] Failed to store registration access token - %v", err)
+			svcs.Clients().Unregister(client.ID)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: kServerError})
+			return
+		}
+
+		resp.ClientID = client.ID
+		resp.ClientIDIssuedAt = time.Now().Unix()
+		resp.RegistrationClientURI = registrationClientURI(r, config, client.ID)
+
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+// ManageRegistration lets a client read, replace or delete its own
+// registration (RFC 7592) using its registration access token.
+func ManageRegistration(config Config) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		cid := web.URLParam(r, "client_id")
+
+		// Unknown clients and bad tokens look the same (RFC 7592, Section 2)
+		client, err := svcs.Clients().Client(cid)
+		if err != nil || !checkRegistrationAccessToken(r, kvs, cid) {
+			log.Printf("[Error] Invalid registration access token for client (%s).", cid)
+			writeBearerError(w, http.StatusUnauthorized, kInvalidTokenError, "")
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, registrationResponse{
+				clientMetadata:        clientToMetadata(client),
+				ClientID:              client.ID,
+				RegistrationClientURI: registrationClientURI(r, config, client.ID),
+			})
+
+		case http.MethodPut:
+			var req registrationRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidClientMetadataError, Description: "malformed JSON body"})
+				return
+			}
+
+			if req.ClientID != client.ID {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidClientMetadataError, Description: "client_id does not match"})
+				return
+			}
+
+			updated, errS, desc := req.toClient(config)
+			if errS == "" && updated.IsConfidential() != client.IsConfidential() {
+				errS, desc = kInvalidClientMetadataError, "a client cannot switch between public and confidential"
+			}
+			if errS != "" {
+				log.Printf("[Error] Rejected client update - %s", desc)
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: errS, Description: desc})
+				return
+			}
+
+			updated.ID = client.ID
+			updated.SecretHash = client.SecretHash
+
+			if err := svcs.Clients().Update(updated); err != nil {
+				log.Printf("[Error] Failed to update client - %v", err)
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidClientMetadataError, Description: err.Error()})
+				return
+			}
+
+			writeJSON(w, http.StatusOK, registrationResponse{
+				clientMetadata:        clientToMetadata(updated),
+				ClientID:              updated.ID,
+				RegistrationClientURI: registrationClientURI(r, config, updated.ID),
+			})
+
+		case http.MethodDelete:
+			if err := svcs.Clients().Unregister(client.ID); err != nil {
+				log.Printf("[Error] Failed to delete client - %v", err)
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: kInvalidClientMetadataError, Description: err.Error()})
+				return
+			}
+
+			kvs.Remove(kRegistrationNamespace, client.ID)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// toClient validates the metadata and turns it into a client with no ID or
+// secret yet. On failure it returns an RFC 7591 error code and description.
+// A client always ends up with an explicit scope allowance; an empty one
+// would let it ask for anything.
+func (md clientMetadata) toClient(config Config) (services.Client, string, string) {
+	client := services.Client{
+		Type:         services.ClientTypeConfidential,
+		AuthMethod:   md.TokenEndpointAuthMethod,
+		RedirectURIs: md.RedirectURIs,
+		GrantTypes:   md.GrantTypes,
+		Scopes:       strings.Fields(md.Scope),
+		Name:         md.ClientName,
+		LogoURI:      md.LogoURI,
+		RequirePAR:   md.RequirePushedAuthorizationRequests,
+	}
+
+	switch client.AuthMethod {
+	case "":
+		// RFC 7591 default
+		client.AuthMethod = kClientAuthBasic
+	case kClientAuthNone:
+		client.Type = services.ClientTypePublic
+	case kClientAuthBasic, kClientAuthPost:
+	default:
+		return services.Client{}, kInvalidClientMetadataError, "unsupported token_endpoint_auth_method"
+	}
+
+	supported := tokenGrants()
+	for _, gt := range client.GrantTypes {
+		if _, ok := supported[gt]; !ok {
+			return services.Client{}, kInvalidClientMetadataError, "unsupported grant type: " + gt
+		}
+	}
+
+	if !client.IsConfidential() && client.AllowsGrant(kGrantClientCredentials) {
+		return services.Client{}, kInvalidClientMetadataError, "public clients cannot use client_credentials"
+	}
+
+	for _, rt := range md.ResponseTypes {
+		if rt != kResponseTypeCode {
+			return services.Client{}, kInvalidClientMetadataError, "unsupported response type: " + rt
+		}
+	}
+
+	if client.AllowsGrant(kGrantAuthorizationCode) && len(client.RedirectURIs) == 0 {
+		return services.Client{}, kInvalidRedirectURIError, "redirect_uris are required for authorization_code"
+	}
+
+	for _, uri := range client.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return services.Client{}, kInvalidRedirectURIError, "invalid redirect URI: " + uri
+		}
+	}
+
+	if len(client.Scopes) == 0 {
+		client.Scopes = append([]string{}, config.Registration.DefaultScopes...)
+	}
+
+	if len(client.Scopes) == 0 {
+		return services.Client{}, kInvalidClientMetadataError, "scope is required"
+	}
+
+	for _, scope := range client.Scopes {
+		if _, ok := config.Scopes[scope]; !ok {
+			return services.Client{}, kInvalidClientMetadataError, "unsupported scope: " + scope
+		}
+	}
+
+	if client.LogoURI != "" {
+		if u, err := url.Parse(client.LogoURI); err != nil || u.Scheme != "https" || u.Host == "" {
+			return services.Client{}, kInvalidClientMetadataError, "logo_uri must be an https URL"
+		}
+	}
+
+	return client, "", ""
+}
+
+func clientToMetadata(client services.Client) clientMetadata {
+	md := clientMetadata{
+		RedirectURIs:            client.RedirectURIs,
+		TokenEndpointAuthMethod: client.AuthMethod,
+		GrantTypes:              client.GrantTypes,
+		ClientName:              client.Name,
+		LogoURI:                 client.LogoURI,
+		Scope:                   strings.Join(client.Scopes, " "),
+
+		RequirePushedAuthorizationRequests: client.RequirePAR,
+	}
+
+	if client.AllowsGrant(kGrantAuthorizationCode) {
+		md.ResponseTypes = []string{kResponseTypeCode}
+	}
+
+	return md
+}
+
+// validRedirectURI accepts absolute https URLs without a fragment, plus plain
+// http for loopback addresses (native apps, RFC 8252).
+func validRedirectURI(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || net.ParseIP(host).IsLoopback()
+	}
+
+	return false
+}
+
+func checkInitialAccessToken(r *http.Request, tokens []string) bool {
+	presented, err := helpers.ParseHttpAuthBearer(r)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range tokens {
+		if t != "" && subtle.ConstantTimeCompare([]byte(t), []byte(presented)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkRegistrationAccessToken(r *http.Request, kvs services.KeyValueStore, cid string) bool {
+	presented, err := helpers.ParseHttpAuthBearer(r)
+	if err != nil {
+		return false
+	}
+
+	value, err := kvs.Read(kRegistrationNamespace, cid)
+	if err != nil {
+		return false
+	}
+
+	hash, ok := value.(string)
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(services.HashClientSecret(presented))) == 1
+}
+
+func registrationClientURI(r *http.Request, config Config, cid string) string {
+	return requestBase(r, config) + kRegisterRoute + "/" + url.PathEscape(cid)
+}
@@ -0,0 +1,61 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestValidRedirectURI(t *testing.T) {
+	test.Require(t, validRedirectURI("https://app.example/cb?x=1"), "https redirect")
+	test.Require(t, validRedirectURI("http://127.0.0.1:8080/cb"), "loopback http redirect")
+	test.Require(t, validRedirectURI("http://localhost/cb"), "localhost http redirect")
+
+	test.Require(t, !validRedirectURI("http://app.example/cb"), "plain http redirect")
+	test.Require(t, !validRedirectURI("https://app.example/cb#frag"), "redirect with fragment")
+	test.Require(t, !validRedirectURI("/cb"), "relative redirect")
+}
+
+func TestClientMetadataDefaults(t *testing.T) {
+	config := DefaultConfig()
+
+	client, errS, _ := clientMetadata{RedirectURIs: []string{"https://app/cb"}}.toClient(config)
+	test.Expect(t, "", errS, "minimal metadata is valid")
+	test.Require(t, client.IsConfidential(), "clients are confidential by default")
+	test.Expect(t, kClientAuthBasic, client.AuthMethod, "default token endpoint auth method")
+	test.Expect(t, kScopeOpenID, strings.Join(client.Scopes, " "), "default scope allowance")
+	test.Require(t, !client.AllowsScope("email"), "default allowance is not unlimited")
+
+	_, errS, _ = clientMetadata{}.toClient(config)
+	test.Expect(t, kInvalidRedirectURIError, errS, "authorization_code needs redirect URIs")
+
+	_, errS, _ = clientMetadata{RedirectURIs: []string{"https://app/cb"}, Scope: "email admin"}.toClient(config)
+	test.Expect(t, kInvalidClientMetadataError, errS, "only registered scopes")
+
+	config.Registration.DefaultScopes = nil
+	_, errS, _ = clientMetadata{RedirectURIs: []string{"https://app/cb"}}.toClient(config)
+	test.Expect(t, kInvalidClientMetadataError, errS, "scope required without defaults")
+}
@@ -0,0 +1,166 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kRevokedTokenNamespace = "revoked"
+)
+
+var (
+	kTokenRevokedError = errors.New("token has been revoked")
+)
+
+// A token found by one of the revocation lookups along with the client it
+// was issued to.
+type revocableToken struct {
+	owner  string
+	revoke func()
+}
+
+// Revoke implements RFC 7009. Unknown, expired and already revoked tokens are
+// not errors; the endpoint answers 200 so clients cannot probe for them.
+func Revoke(minter *TokenMinter) func(w http.ResponseWriter, r *http.Request) {
+	verifier := minter.Verifier()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+
+		client, err := requestClient(r, svcs)
+		if err != nil {
+			log.Printf("[Error] Client authentication failed on revocation - %v", err)
+			writeClientAuthError(w, r, err)
+			return
+		}
+
+		token := r.PostFormValue("token")
+		if token == "" {
+			writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "missing token")
+			return
+		}
+
+		kvs := svcs.Ephemeral().KeyValues()
+
+		// The hint only decides which lookup goes first
+		lookups := []func() (revocableToken, bool){
+			func() (revocableToken, bool) { return findAccessToken(kvs, verifier, token) },
+			func() (revocableToken, bool) { return findRefreshToken(kvs, token) },
+		}
+		if r.PostFormValue("token_type_hint") == kTokenTypeHintRefresh {
+			lookups[0], lookups[1] = lookups[1], lookups[0]
+		}
+
+		for _, lookup := range lookups {
+			found, ok := lookup()
+			if !ok {
+				continue
+			}
+
+			if found.owner != client.ID {
+				log.Printf("[Error] Client (%s) tried to revoke a token issued to another client.", client.ID)
+				writeTokenError(w, http.StatusBadRequest, kUnauthorizedClientError, "token was not issued to this client")
+				return
+			}
+
+			found.revoke()
+			break
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func findAccessToken(kvs services.KeyValueStore, verifier *TokenVerifier, token string) (revocableToken, bool) {
+	claims, err := verifier.VerifyAccessToken(token)
+	if err != nil {
+		return revocableToken{}, false
+	}
+
+	return revocableToken{
+		owner:  claims.ClientID,
+		revoke: func() { revokeAccessToken(kvs, claims) },
+	}, true
+}
+
+func findRefreshToken(kvs services.KeyValueStore, token string) (revocableToken, bool) {
+	data, _, err := readRefreshToken(kvs, token)
+	if err != nil {
+		return revocableToken{}, false
+	}
+
+	// Revoking the family also deactivates every access token minted from it
+	return revocableToken{
+		owner:  data.Grant.ClientID,
+		revoke: func() { revokeRefreshFamily(kvs, data.FamilyID) },
+	}, true
+}
+
+/**
+ * Access token records and the revocation denylist
+ **/
+
+// revokeAccessToken drops the token's record and denylists its jti until the
+// token would have expired anyway.
+func revokeAccessToken(kvs services.KeyValueStore, claims *AccessTokenClaims) {
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0))
+	if ttl > 0 {
+		if err := kvs.Set(kRevokedTokenNamespace, claims.ID, true, ttl); err != nil {
+			log.Printf("[Error] Failed to denylist revoked token (%s) - %v", claims.ID, err)
+		}
+	}
+
+	kvs.Remove(kAccessTokenNamespace, claims.ID)
+}
+
+func tokenRevoked(kvs services.KeyValueStore, jti string) bool {
+	_, err := kvs.Read(kRevokedTokenNamespace, jti)
+	return err == nil
+}
+
+func readAccessToken(kvs services.KeyValueStore, jti string) (accessTokenRecord, error) {
+	if tokenRevoked(kvs, jti) {
+		return accessTokenRecord{}, kTokenRevokedError
+	}
+
+	value, err := kvs.Read(kAccessTokenNamespace, jti)
+	if err != nil {
+		return accessTokenRecord{}, err
+	}
+
+	record := value.(accessTokenRecord)
+	if record.FamilyID != "" {
+		if _, err := kvs.Read(kRefreshFamilyNamespace, record.FamilyID); err != nil {
+			return accessTokenRecord{}, kTokenRevokedError
+		}
+	}
+
+	return record, nil
+}
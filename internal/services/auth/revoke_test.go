@@ -0,0 +1,79 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestRevoke(t *testing.T) {
+	config := testConfig()
+	minter := testMinter(t, config)
+	verifier := minter.Verifier()
+	svcs, kvs := testServices(
+		services.Client{ID: "app", Type: services.ClientTypePublic},
+		services.Client{ID: "other", Type: services.ClientTypePublic},
+	)
+
+	grant := services.AuthCodeData{UID: "dude", ClientID: "app", Scope: "read"}
+	fid, refresh, err := startRefreshFamily(kvs, grant, config)
+	test.NoError(t, err, "starting refresh family")
+	familyToken, _, err := minter.Issue(kvs, grant, fid)
+	test.NoError(t, err, "issuing family access token")
+	access, claims, err := minter.Issue(kvs, grant, "")
+	test.NoError(t, err, "issuing access token")
+
+	revoke := func(cid, token, hint string) int {
+		form := url.Values{"client_id": {cid}, "token": {token}}
+		if hint != "" {
+			form.Set("token_type_hint", hint)
+		}
+
+		w := httptest.NewRecorder()
+		Revoke(minter)(w, formRequest(svcs, "/auth/revoke", form))
+		return w.Code
+	}
+
+	test.Expect(t, http.StatusOK, revoke("app", "garbage", ""), "unknown tokens are not errors")
+
+	test.Expect(t, http.StatusBadRequest, revoke("other", access, ""), "another client's token")
+	_, err = verifier.VerifyActive(kvs, access)
+	test.NoError(t, err, "token survives a foreign revocation")
+
+	test.Expect(t, http.StatusOK, revoke("app", access, ""), "owner revokes")
+	_, err = verifier.VerifyActive(kvs, access)
+	test.SpecificError(t, err, kTokenRevokedError, "revoked token is denylisted")
+	test.Require(t, tokenRevoked(kvs, claims.ID), "jti is on the denylist")
+
+	test.Expect(t, http.StatusOK, revoke("app", refresh, kTokenTypeHintRefresh), "owner revokes refresh token")
+	_, _, err = readRefreshToken(kvs, refresh)
+	test.AnyError(t, err, "refresh token family is gone")
+	_, err = verifier.VerifyActive(kvs, familyToken)
+	test.SpecificError(t, err, kTokenRevokedError, "family access tokens are revoked too")
+}
@@ -0,0 +1,243 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kSessionIDSize = 32
+
+	kSessionContextKey = "sl.auth.session"
+
+	kSessionNamespace = "session"
+
+	// OpenID Connect 'prompt' value that forces the login form
+	kPromptLogin = "login"
+
+	kLoginRequiredError = "login_required"
+)
+
+/**
+ *
+ * Browser sessions let /authorize skip the login form for someone who signed
+ * in recently, for any client. The cookie only carries the session ID and an
+ * HMAC over it; the session itself lives in the ephemeral store, where the
+ * idle timeout is the item's ttl (pushed back on every use) and the absolute
+ * timeout is fixed when the session starts.
+ *
+ **/
+
+type browserSession struct {
+	UID      string
+	AuthTime time.Time
+	AMR      []string
+	Expires  time.Time
+}
+
+type sessionManager struct {
+	config SessionConfig
+	key    []byte
+	path   string
+	secure bool
+}
+
+func newSessionManager(config Config) *sessionManager {
+	key := []byte(config.Secret)
+	if len(key) == 0 {
+		// Sessions are kept in memory anyway, so a per-process key only costs
+		// logins across restarts
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("[ERROR] Failed to generate session signing key - %v", err)
+		}
+	}
+
+	return &sessionManager{
+		config: config.Session,
+		key:    key,
+		path:   cookiePath(config),
+		secure: strings.HasPrefix(config.Issuer, "https://"),
+	}
+}
+
+func sessionsFromContext(ctx context.Context) *sessionManager {
+	return ctx.Value(kSessionContextKey).(*sessionManager)
+}
+
+// start records a new session for the user in data and hands the browser its
+// cookie. Any session the browser already had is replaced.
+func (m *sessionManager) start(w http.ResponseWriter, r *http.Request, kvs services.KeyValueStore, data services.AuthCodeData) {
+	if !m.config.Enabled {
+		return
+	}
+
+	m.end(w, r, kvs)
+
+	session := browserSession{
+		UID:      data.UID,
+		AuthTime: data.AuthTime,
+		AMR:      data.AMR,
+		Expires:  time.Now().Add(m.config.MaxTTL),
+	}
+
+	sid, err := storeWithRandomKey(kvs, kSessionNamespace, kSessionIDSize, session, m.ttl(session))
+	if err != nil {
+		// The login itself still succeeds; the user just signs in again next time
+		log.Printf("[Error] Failed to start browser session - %v", err)
+		return
+	}
+
+	m.setCookie(w, r, sid+"."+m.sign(sid), int(m.config.MaxTTL.Seconds()))
+}
+
+// current returns the browser's live session, pushing back its idle timeout.
+func (m *sessionManager) current(r *http.Request, kvs services.KeyValueStore) (browserSession, bool) {
+	sid, ok := m.sessionID(r)
+	if !ok {
+		return browserSession{}, false
+	}
+
+	value, err := kvs.Read(kSessionNamespace, sid)
+	if err != nil {
+		return browserSession{}, false
+	}
+
+	session, ok := value.(browserSession)
+	if !ok || !time.Now().Before(session.Expires) {
+		return browserSession{}, false
+	}
+
+	// Losing a race with a concurrent request only means its refresh won
+	if err := kvs.Refresh(kSessionNamespace, sid, m.ttl(session)); err != nil {
+		log.Printf("[Error] Failed to refresh browser session - %v", err)
+	}
+
+	return session, true
+}
+
+// end removes the browser's session, if any, and clears the cookie.
+func (m *sessionManager) end(w http.ResponseWriter, r *http.Request, kvs services.KeyValueStore) {
+	if sid, ok := m.sessionID(r); ok {
+		kvs.Remove(kSessionNamespace, sid)
+	}
+
+	if _, err := r.Cookie(m.config.CookieName); err == nil {
+		m.setCookie(w, r, "", -1)
+	}
+}
+
+func (m *sessionManager) sessionID(r *http.Request) (string, bool) {
+	if !m.config.Enabled {
+		return "", false
+	}
+
+	cookie, err := r.Cookie(m.config.CookieName)
+	if err != nil {
+		return "", false
+	}
+
+	sid, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(m.sign(sid))) {
+		return "", false
+	}
+
+	return sid, true
+}
+
+func (m *sessionManager) sign(sid string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(kSessionNamespace + ":" + sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// ttl is the idle timeout, cut short by the absolute one.
+func (m *sessionManager) ttl(session browserSession) time.Duration {
+	ttl := time.Until(session.Expires)
+	if ttl > m.config.IdleTTL {
+		ttl = m.config.IdleTTL
+	}
+
+	return ttl
+}
+
+func (m *sessionManager) setCookie(w http.ResponseWriter, r *http.Request, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.config.CookieName,
+		Value:    value,
+		Path:     m.path,
+		MaxAge:   maxAge,
+		Secure:   m.secure || r.TLS != nil,
+		HttpOnly: true,
+		// Lax still sends the cookie on the top level navigation to /authorize
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// cookiePath scopes the auth service's cookies to its own routes.
+func cookiePath(config Config) string {
+	path := strings.TrimSuffix(config.Path, "/")
+	if path == "" {
+		return "/"
+	}
+
+	return path
+}
+
+// finishLogin starts a browser session for the user who just signed in and
+// carries on with their authorization request.
+func finishLogin(w http.ResponseWriter, r *http.Request, config Config, svcs services.Services, data services.AuthCodeData) {
+	sessionsFromContext(r.Context()).start(w, r, svcs.Ephemeral().KeyValues(), data)
+	completeAuthorization(w, r, config, svcs, data)
+}
+
+// sessionSatisfies reports whether an existing session can answer an
+// authorization request without showing the login form.
+func sessionSatisfies(session browserSession, prompt, maxAge string) bool {
+	if hasScope(prompt, kPromptLogin) {
+		return false
+	}
+
+	if maxAge == "" {
+		return true
+	}
+
+	secs, err := strconv.ParseInt(maxAge, 10, 64)
+	if err != nil || secs < 0 {
+		return false
+	}
+
+	return time.Since(session.AuthTime) <= time.Duration(secs)*time.Second
+}
@@ -0,0 +1,41 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestSessionSatisfies(t *testing.T) {
+	session := browserSession{UID: "1", AuthTime: time.Now().Add(-time.Minute)}
+
+	test.Require(t, sessionSatisfies(session, "", ""), "plain request reuses the session")
+	test.Require(t, sessionSatisfies(session, "consent", ""), "other prompts reuse the session")
+	test.Require(t, !sessionSatisfies(session, "login", ""), "prompt=login forces the form")
+	test.Require(t, sessionSatisfies(session, "", "300"), "recent enough for max_age")
+	test.Require(t, !sessionSatisfies(session, "", "30"), "too old for max_age")
+	test.Require(t, !sessionSatisfies(session, "", "soon"), "malformed max_age forces the form")
+}
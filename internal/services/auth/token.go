@@ -0,0 +1,224 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kGrantAuthorizationCode = "authorization_code"
+
+	kTokenTypeBearer = "Bearer"
+
+	kTokenGenRetries = 10
+)
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+
+	// Token exchange responses (RFC 8693, Section 2.2.1)
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+type errorResponse struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type grantHandler func(w http.ResponseWriter, r *http.Request, config Config, minter *TokenMinter)
+
+// tokenGrants maps every grant_type the token endpoint accepts to its handler.
+// This is also what the discovery document advertises.
+func tokenGrants() map[string]grantHandler {
+	return map[string]grantHandler{
+		kGrantAuthorizationCode: tokenFromAuthorizationCode,
+		kGrantRefreshToken:      tokenFromRefreshToken,
+		kGrantClientCredentials: tokenFromClientCredentials,
+		kGrantDeviceCode:        tokenFromDeviceCode,
+		kGrantTokenExchange:     tokenFromTokenExchange,
+	}
+}
+
+func Token(config Config, minter *TokenMinter) func(w http.ResponseWriter, r *http.Request) {
+	grants := tokenGrants()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		gt := r.PostFormValue("grant_type")
+		if gt == "" {
+			writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "missing grant_type")
+			return
+		}
+
+		grant, ok := grants[gt]
+		if !ok {
+			log.Printf("[Error] Unsupported grant_type (%s) in token request.", gt)
+			writeTokenError(w, http.StatusBadRequest, kUnsupportedGrantType, "")
+			return
+		}
+
+		if limiter := loginLimiterFromContext(r.Context()); limiter.locked(r, tokenRequestClientID(r)) {
+			limiter.writeLockedOut(w)
+			return
+		}
+
+		jkt, ok := tokenRequestDPoP(w, r, config)
+		if !ok {
+			return
+		}
+
+		grant(w, withDPoPKey(r, jkt), config, minter)
+	}
+}
+
+func tokenFromAuthorizationCode(w http.ResponseWriter, r *http.Request, config Config, minter *TokenMinter) {
+	code := r.PostFormValue("code")
+	redir := r.PostFormValue("redirect_uri")
+	verifier := r.PostFormValue("code_verifier")
+
+	if code == "" {
+		writeTokenError(w, http.StatusBadRequest, kInvalidRequestError, "missing code")
+		return
+	}
+
+	svcs := services.ServicesFromContext(r.Context())
+
+	client, ok := requestClientForGrant(w, r, svcs, kGrantAuthorizationCode)
+	if !ok {
+		return
+	}
+
+	// Authorization codes are single use, so the code is consumed regardless of
+	// whether the rest of the request checks out.
+	value, err := svcs.Ephemeral().KeyValues().ReadAndRemove(services.AuthCodeNamespace, code)
+	if err != nil {
+		log.Printf("[Error] Failed to redeem authorization code - %v", err)
+		// No secret was involved, so this never counts against the client
+		loginLimiterFromContext(r.Context()).failed(r, "")
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "invalid or expired authorization code")
+		return
+	}
+
+	data, ok := value.(services.AuthCodeData)
+	if !ok {
+		log.Print("[Error] Unexpected value stored for authorization code.")
+		writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		return
+	}
+
+	if data.ClientID != client.ID {
+		log.Print("[Error] Authorization code was not issued to the requesting client.")
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "client_id mismatch")
+		return
+	}
+
+	if data.RedirectURI != redir {
+		log.Print("[Error] Redirect URI does not match the authorization request.")
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, "redirect_uri mismatch")
+		return
+	}
+
+	if err := verifyCodeChallenge(data.Challenge, data.ChallengeMethod, verifier); err != nil {
+		log.Printf("[Error] PKCE verification failed - %v", err)
+		writeTokenError(w, http.StatusBadRequest, kInvalidGrantError, err.Error())
+		return
+	}
+
+	data.JKT = dpopKeyFromContext(r.Context())
+	data.X5T = clientCertThumbprint(r)
+	issueUserTokens(w, svcs.Ephemeral().KeyValues(), data, config, minter)
+}
+
+// issueUserTokens answers a grant made by a user: an access token, a new
+// refresh token family and, for OpenID Connect requests, an ID token. Both
+// tokens are bound to data.JKT when it is set; the access token is also bound
+// to data.X5T.
+func issueUserTokens(w http.ResponseWriter, kvs services.KeyValueStore, data services.AuthCodeData, config Config, minter *TokenMinter) {
+	fid, refresh, err := startRefreshFamily(kvs, data, config)
+	if err != nil {
+		log.Printf("[Error] Failed to issue refresh token - %v", err)
+		writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		return
+	}
+
+	token, _, err := minter.Issue(kvs, data, fid)
+	if err != nil {
+		log.Printf("[Error] Failed to issue access token - %v", err)
+		writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+		return
+	}
+
+	var idToken string
+	if hasScope(data.Scope, kScopeOpenID) {
+		if idToken, err = minter.MintIDToken(data, token); err != nil {
+			log.Printf("[Error] Failed to issue ID token - %v", err)
+			writeTokenError(w, http.StatusInternalServerError, kServerError, "")
+			return
+		}
+	}
+
+	writeTokenResponse(w, tokenResponse{
+		AccessToken:  token,
+		TokenType:    tokenType(data.JKT),
+		ExpiresIn:    int64(config.TokenTTL.Seconds()),
+		RefreshToken: refresh,
+		Scope:        data.Scope,
+		IDToken:      idToken,
+	})
+}
+
+/**
+ * Token endpoint response helpers
+ **/
+
+func writeTokenResponse(w http.ResponseWriter, resp tokenResponse) {
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeTokenError(w http.ResponseWriter, status int, errS, desc string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+
+	writeJSON(w, status, errorResponse{Error: errS, Description: desc})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[Error] Failed to encode JSON response - %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"time"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/jwt"
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	// RFC 9068 media type for JWT access tokens
+	kAccessTokenType = "at+jwt"
+
+	kTokenIDSize = 24
+
+	kAccessTokenNamespace = "access_token"
+)
+
+var (
+	kWrongTokenTypeError = errors.New("token is not an access token")
+	kNotIDTokenError     = errors.New("token is not an ID token")
+	kIDTokenKeyError     = errors.New("ID tokens need an asymmetric signing key")
+)
+
+type AccessTokenClaims struct {
+	jwt.RegisteredClaims
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+
+	// Set on DPoP (RFC 9449, Section 6) and certificate (RFC 8705, Section 3)
+	// bound tokens
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+
+	// Set on tokens a delegation exchange produced (RFC 8693, Section 4.1)
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Confirmation binds an access token to a key (RFC 7800): the thumbprint of
+// the DPoP proof key, of the client's TLS certificate, or both.
+type Confirmation struct {
+	JKT string `json:"jkt,omitempty"`
+	X5T string `json:"x5t#S256,omitempty"`
+}
+
+// OpenID Connect ID token (Core, Section 2)
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	AuthTime        int64    `json:"auth_time,omitempty"`
+	Nonce           string   `json:"nonce,omitempty"`
+	AMR             []string `json:"amr,omitempty"`
+	AccessTokenHash string   `json:"at_hash,omitempty"`
+}
+
+// What the ephemeral store keeps for every issued access token. Tokens minted
+// from a refresh token family die with that family.
+type accessTokenRecord struct {
+	Claims   AccessTokenClaims
+	FamilyID string
+}
+
+/**
+ *
+ * TokenMinter issues signed access tokens for the token endpoint.
+ *
+ **/
+type TokenMinter struct {
+	key    *jwt.Key
+	keys   []*jwt.Key
+	issuer string
+	ttl    time.Duration
+}
+
+func NewTokenMinter(config Config) (*TokenMinter, error) {
+	key, keys, err := loadSigningKeys(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenMinter{
+		key:    key,
+		keys:   keys,
+		issuer: config.Issuer,
+		ttl:    config.TokenTTL,
+	}, nil
+}
+
+// accessTokenClaims fills in the claims of a new access token for the grant
+// in data, aimed at the client it was made for.
+func (m *TokenMinter) accessTokenClaims(data services.AuthCodeData) (*AccessTokenClaims, error) {
+	jti, err := helpers.GenerateStringSecure(kTokenIDSize, helpers.AlphaNumeric)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := &AccessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   data.UID,
+			Audience:  jwt.Audience{data.ClientID},
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(m.ttl).Unix(),
+			ID:        jti,
+		},
+		ClientID: data.ClientID,
+		Scope:    data.Scope,
+	}
+
+	if data.JKT != "" || data.X5T != "" {
+		claims.Confirmation = &Confirmation{JKT: data.JKT, X5T: data.X5T}
+	}
+
+	return claims, nil
+}
+
+func (m *TokenMinter) signAccessToken(claims *AccessTokenClaims) (string, error) {
+	return jwt.SignWithHeader(m.key, jwt.Header{Type: kAccessTokenType}, claims)
+}
+
+// MintIDToken issues an ID token for the user in data, bound to the access
+// token it accompanies through at_hash.
+func (m *TokenMinter) MintIDToken(data services.AuthCodeData, accessToken string) (string, error) {
+	if m.key.Algorithm == jwt.HS256 {
+		return "", kIDTokenKeyError
+	}
+
+	now := time.Now()
+	claims := IDTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   data.UID,
+			Audience:  jwt.Audience{data.ClientID},
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(m.ttl).Unix(),
+		},
+		Nonce:           data.Nonce,
+		AMR:             data.AMR,
+		AccessTokenHash: m.tokenHash(accessToken),
+	}
+
+	if !data.AuthTime.IsZero() {
+		claims.AuthTime = data.AuthTime.Unix()
+	}
+
+	return jwt.Sign(m.key, claims)
+}
+
+// tokenHash is the at_hash / c_hash construction: the left half of the hash
+// used by the signing algorithm, base64url encoded.
+func (m *TokenMinter) tokenHash(token string) string {
+	var h hash.Hash
+	if m.key.Algorithm == jwt.EdDSA {
+		h = sha512.New()
+	} else {
+		h = sha256.New()
+	}
+
+	h.Write([]byte(token))
+	sum := h.Sum(nil)
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// Issue mints an access token and records it, keyed by jti, for the
+// remainder of its lifetime so it can be introspected and revoked. The
+// family ID is empty when no refresh token backs the grant.
+func (m *TokenMinter) Issue(kvs services.KeyValueStore, data services.AuthCodeData, fid string) (string, *AccessTokenClaims, error) {
+	claims, err := m.accessTokenClaims(data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return m.issueClaims(kvs, claims, fid)
+}
+
+// issueClaims is Issue for claims a grant has already adjusted.
+func (m *TokenMinter) issueClaims(kvs services.KeyValueStore, claims *AccessTokenClaims, fid string) (string, *AccessTokenClaims, error) {
+	token, err := m.signAccessToken(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	record := accessTokenRecord{Claims: *claims, FamilyID: fid}
+	if err := kvs.Set(kAccessTokenNamespace, claims.ID, record, m.ttl); err != nil {
+		return "", nil, err
+	}
+
+	return token, claims, nil
+}
+
+func (m *TokenMinter) Verifier() *TokenVerifier {
+	return newTokenVerifier(m.keys, m.issuer)
+}
+
+// JWKS returns the public halves of the asymmetric keys in use. Shared secret
+// (HS256) keys are never published.
+func (m *TokenMinter) JWKS() jwt.JWKSet {
+	set := jwt.JWKSet{Keys: []jwt.JWK{}}
+
+	for _, k := range m.keys {
+		if jwk, err := k.JWK(); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	return set
+}
+
+/**
+ *
+ * TokenVerifier validates access tokens minted by this service. Resource
+ * servers should build one from the same auth.Config the issuer uses.
+ *
+ **/
+type TokenVerifier struct {
+	verifier jwt.Verifier
+}
+
+func NewTokenVerifier(config Config) (*TokenVerifier, error) {
+	_, keys, err := loadSigningKeys(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTokenVerifier(keys, config.Issuer), nil
+}
+
+func newTokenVerifier(keys []*jwt.Key, issuer string) *TokenVerifier {
+	return &TokenVerifier{
+		verifier: jwt.Verifier{
+			Keys:   keys,
+			Issuer: issuer,
+		},
+	}
+}
+
+func (v *TokenVerifier) VerifyAccessToken(token string) (*AccessTokenClaims, error) {
+	claims := &AccessTokenClaims{}
+
+	parsed, err := v.verifier.Verify(token, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Header.Type != kAccessTokenType {
+		return nil, kWrongTokenTypeError
+	}
+
+	return claims, nil
+}
+
+// VerifyIDTokenHint checks an ID token this service issued, as sent back in
+// an id_token_hint. Expired tokens are fine here; the signature and issuer are
+// what tie the hint to this service.
+func (v *TokenVerifier) VerifyIDTokenHint(token string) (*IDTokenClaims, error) {
+	parsed, err := jwt.Parse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Header.Type == kAccessTokenType {
+		return nil, kNotIDTokenError
+	}
+
+	var registered jwt.RegisteredClaims
+	if err := parsed.Claims(&registered); err != nil {
+		return nil, err
+	}
+
+	// Check the lifetime as of issuance, which only rejects nonsense
+	verifier := v.verifier
+	verifier.Now = func() time.Time { return time.Unix(registered.IssuedAt, 0) }
+
+	claims := &IDTokenClaims{}
+	if _, err := verifier.Verify(token, claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// VerifyActive is VerifyAccessToken plus the checks that need the auth
+// service's store: the token must still be recorded, must not be on the
+// revocation denylist and its refresh token family (if any) must be alive.
+func (v *TokenVerifier) VerifyActive(kvs services.KeyValueStore, token string) (*AccessTokenClaims, error) {
+	claims, err := v.VerifyAccessToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := readAccessToken(kvs, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record.Claims, nil
+}
+
+// loadSigningKeys returns the key used for signing along with the public
+// halves of every trusted key (the signing key included).
+func loadSigningKeys(config Config) (*jwt.Key, []*jwt.Key, error) {
+	key, err := loadKey(config.Signing.KeyConfig, config.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := []*jwt.Key{key.Public()}
+	for _, kc := range config.Signing.Rotated {
+		rotated, err := loadKey(kc, config.Secret)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		keys = append(keys, rotated.Public())
+	}
+
+	return key, keys, nil
+}
+
+func loadKey(kc KeyConfig, secret string) (*jwt.Key, error) {
+	if kc.Algorithm == jwt.HS256 {
+		return jwt.NewHMACKey(kc.KeyID, []byte(secret))
+	}
+
+	key, err := jwt.LoadKeyFile(kc.KeyID, kc.Algorithm, kc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if key.ID == "" {
+		if key.ID, err = key.Thumbprint(); err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
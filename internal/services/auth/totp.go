@@ -0,0 +1,389 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/web"
+)
+
+const (
+	kMFARoute        = "/mfa"
+	kTOTPEnrollRoute = "/totp/enroll"
+
+	kMFATemplate        = "mfa.html"
+	kTOTPEnrollTemplate = "totp.html"
+
+	kMFARequestIDSize   = 20
+	kMFAPendingTTL      = 5 * time.Minute
+	kMaxMFAAttempts     = 5
+	kTOTPEnrollTTL      = 10 * time.Minute
+	kRecoveryCodeLength = 10
+
+	kMFAPendingNamespace   = "mfa_pending"
+	kTOTPEnrollNamespace   = "totp_enroll"
+	kTOTPUsedNamespace     = "totp_used"
+	kRecoveryUsedNamespace = "recovery_used"
+
+	// RFC 8176 authentication method reference
+	kAMROneTimePassword = "otp"
+
+	// Steps of the enrollment page
+	kEnrollStepLogin   = "login"
+	kEnrollStepConfirm = "confirm"
+	kEnrollStepDone    = "done"
+)
+
+var (
+	kSecondFactorError = errors.New("invalid or already used code")
+)
+
+// A login that passed the password check and waits for the second factor
+type mfaPending struct {
+	Grant    services.AuthCodeData
+	Attempts int
+	Expires  time.Time
+}
+
+// A TOTP secret shown to the user but not yet confirmed with a code
+type totpEnrollment struct {
+	UID    string
+	Secret string
+}
+
+type mfaViewData struct {
+	RequestID string
+	Error     string
+	CSRFField template.HTML
+}
+
+type totpViewData struct {
+	Step          string
+	EnrollID      string
+	Secret        string
+	QRCode        template.URL
+	RecoveryCodes []string
+	Error         string
+	CSRFField     template.HTML
+}
+
+// startSecondFactor parks a password-verified login and sends the browser to
+// the second factor page.
+func startSecondFactor(w http.ResponseWriter, r *http.Request, config Config, kvs services.KeyValueStore, data services.AuthCodeData) {
+	pending := mfaPending{Grant: data, Expires: time.Now().Add(kMFAPendingTTL)}
+
+	rid, err := storeWithRandomKey(kvs, kMFAPendingNamespace, kMFARequestIDSize, pending, kMFAPendingTTL)
+	if err != nil {
+		log.Printf("[Error] Failed to start second factor - %v", err)
+		redirectAuthError(w, r, config, data, kServerError, "")
+		return
+	}
+
+	trackPending(kvs, data.UID, kMFAPendingNamespace, rid, kMFAPendingTTL)
+	http.Redirect(w, r, strings.TrimSuffix(config.Path, "/")+kMFARoute+"?rid="+rid, http.StatusSeeOther)
+}
+
+// SecondFactor asks for a TOTP (or recovery) code before the authorization
+// code is issued. Bad codes count against the account like bad passwords.
+func SecondFactor(templates *template.Template, config Config) func(w http.ResponseWriter, r *http.Request) {
+	render := func(w http.ResponseWriter, r *http.Request, status int, data mfaViewData) {
+		data.CSRFField = web.CSRFTemplateField(r)
+		w.WriteHeader(status)
+		if err := templates.ExecuteTemplate(w, kMFATemplate, data); err != nil {
+			log.Printf("[Error] Failed to execute 'mfa' template - %v", err)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+		rid := r.FormValue("rid")
+
+		// An attempt takes the request out of the store while the code is
+		// checked, so concurrent guesses can't share one attempt count
+		var pending mfaPending
+		var err error
+		if r.Method == http.MethodGet {
+			pending, err = readMFAPending(kvs, rid)
+		} else {
+			pending, err = takeMFAPending(kvs, rid)
+		}
+		if err != nil {
+			log.Printf("[Error] Unknown second factor request - %v", err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			render(w, r, http.StatusOK, mfaViewData{RequestID: rid})
+			return
+		}
+
+		data := pending.Grant
+
+		user, err := svcs.Users().User(data.UID)
+		limiter := loginLimiterFromContext(r.Context())
+		if err == nil && limiter.locked(r, user.Username) {
+			redirectAuthError(w, r, config, data, kAccessDeniedError, kLockedOutDescription)
+			return
+		}
+
+		if err != nil || !checkSecondFactor(svcs, kvs, &user, r.PostFormValue("code"), config.TOTP.Skew) {
+			limiter.failed(r, user.Username)
+
+			pending.Attempts++
+			if pending.Attempts >= kMaxMFAAttempts {
+				log.Printf("[Error] Too many second factor attempts for user (%s).", data.UID)
+				redirectAuthError(w, r, config, data, kAccessDeniedError, "too many invalid second factor codes")
+				return
+			}
+
+			kvs.Set(kMFAPendingNamespace, rid, pending, time.Until(pending.Expires))
+			render(w, r, http.StatusUnauthorized, mfaViewData{RequestID: rid, Error: "That code didn't work, try again."})
+			return
+		}
+
+		data.AMR = append(data.AMR, kAMROneTimePassword)
+
+		finishLogin(w, r, config, svcs, data)
+	}
+}
+
+// TOTPEnroll walks a user through adding (or replacing) an authenticator app:
+// sign in, scan the provisioning QR code, confirm with a code, receive the
+// recovery codes. Replacing an existing enrollment needs a current code too.
+func TOTPEnroll(templates *template.Template, config Config) func(w http.ResponseWriter, r *http.Request) {
+	render := func(w http.ResponseWriter, r *http.Request, status int, data totpViewData) {
+		data.CSRFField = web.CSRFTemplateField(r)
+		w.WriteHeader(status)
+		if err := templates.ExecuteTemplate(w, kTOTPEnrollTemplate, data); err != nil {
+			log.Printf("[Error] Failed to execute 'totp' template - %v", err)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			render(w, r, http.StatusOK, totpViewData{Step: kEnrollStepLogin})
+			return
+		}
+
+		svcs := services.ServicesFromContext(r.Context())
+		kvs := svcs.Ephemeral().KeyValues()
+
+		if eid := r.PostFormValue("eid"); eid != "" {
+			confirmTOTPEnrollment(w, r, svcs, kvs, config, eid, r.PostFormValue("code"), render)
+			return
+		}
+
+		limiter := loginLimiterFromContext(r.Context())
+		if limiter.locked(r, r.PostFormValue("user")) {
+			render(w, r, http.StatusTooManyRequests, totpViewData{Step: kEnrollStepLogin, Error: "Too many failed attempts, try again later."})
+			return
+		}
+
+		uid, err := svcs.Authorizer().Authenticate(r.PostFormValue("user"), r.PostFormValue("pwd"))
+		if err != nil {
+			log.Printf("[Error] Authentication failed - %v", err)
+			limiter.failed(r, r.PostFormValue("user"))
+			render(w, r, http.StatusUnauthorized, totpViewData{Step: kEnrollStepLogin, Error: "Invalid username or password."})
+			return
+		}
+
+		user, err := svcs.Users().User(uid)
+		if err != nil {
+			log.Printf("[Error] Failed to load user (%s) - %v", uid, err)
+			render(w, r, http.StatusInternalServerError, totpViewData{Step: kEnrollStepLogin, Error: http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+
+		if user.HasTOTP() && !checkSecondFactor(svcs, kvs, &user, r.PostFormValue("code"), config.TOTP.Skew) {
+			limiter.failed(r, r.PostFormValue("user"))
+			render(w, r, http.StatusUnauthorized, totpViewData{Step: kEnrollStepLogin, Error: "A current code is required to replace your authenticator."})
+			return
+		}
+
+		secret, err := helpers.GenerateTOTPSecret()
+		if err != nil {
+			log.Printf("[Error] Failed to generate TOTP secret - %v", err)
+			render(w, r, http.StatusInternalServerError, totpViewData{Step: kEnrollStepLogin, Error: http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+
+		png, err := qrcode.Encode(helpers.TOTPProvisioningURI(config.TOTP.Issuer, user.Username, secret), kQRErrorCorrectionQuality, kQRImageSize)
+		if err != nil {
+			log.Printf("[Error] Failed to generate TOTP QR code - %v", err)
+			render(w, r, http.StatusInternalServerError, totpViewData{Step: kEnrollStepLogin, Error: http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+
+		eid, err := storeWithRandomKey(kvs, kTOTPEnrollNamespace, kMFARequestIDSize, totpEnrollment{UID: uid, Secret: secret}, kTOTPEnrollTTL)
+		if err != nil {
+			log.Printf("[Error] Failed to start TOTP enrollment - %v", err)
+			render(w, r, http.StatusInternalServerError, totpViewData{Step: kEnrollStepLogin, Error: http.StatusText(http.StatusInternalServerError)})
+			return
+		}
+
+		render(w, r, http.StatusOK, totpViewData{
+			Step:     kEnrollStepConfirm,
+			EnrollID: eid,
+			Secret:   secret,
+			QRCode:   template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)),
+		})
+	}
+}
+
+func confirmTOTPEnrollment(w http.ResponseWriter, r *http.Request, svcs services.Services, kvs services.KeyValueStore, config Config, eid, code string, render func(http.ResponseWriter, *http.Request, int, totpViewData)) {
+	value, err := kvs.Read(kTOTPEnrollNamespace, eid)
+	enrollment, ok := value.(totpEnrollment)
+	if err != nil || !ok {
+		render(w, r, http.StatusBadRequest, totpViewData{Step: kEnrollStepLogin, Error: "Enrollment expired, please start again."})
+		return
+	}
+
+	if !useTOTPCode(kvs, enrollment.UID, enrollment.Secret, code, config.TOTP.Skew) {
+		render(w, r, http.StatusUnauthorized, totpViewData{Step: kEnrollStepConfirm, EnrollID: eid, Secret: enrollment.Secret, Error: "That code didn't work, try again."})
+		return
+	}
+
+	user, err := svcs.Users().User(enrollment.UID)
+	if err != nil {
+		log.Printf("[Error] Failed to load user (%s) - %v", enrollment.UID, err)
+		render(w, r, http.StatusInternalServerError, totpViewData{Step: kEnrollStepLogin, Error: http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	codes, err := generateRecoveryCodes(config.TOTP.RecoveryCodes)
+	if err != nil {
+		log.Printf("[Error] Failed to generate recovery codes - %v", err)
+		render(w, r, http.StatusInternalServerError, totpViewData{Step: kEnrollStepLogin, Error: http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	user.TOTPSecret = enrollment.Secret
+	user.SetRecoveryCodes(codes)
+
+	if err := svcs.Users().Update(user); err != nil {
+		log.Printf("[Error] Failed to save TOTP enrollment - %v", err)
+		render(w, r, http.StatusInternalServerError, totpViewData{Step: kEnrollStepLogin, Error: http.StatusText(http.StatusInternalServerError)})
+		return
+	}
+
+	kvs.Remove(kTOTPEnrollNamespace, eid)
+	render(w, r, http.StatusOK, totpViewData{Step: kEnrollStepDone, RecoveryCodes: codes})
+}
+
+// checkSecondFactor accepts a current TOTP code (once) or one of the user's
+// unused recovery codes, which is then spent. The code is claimed in kvs
+// before the user is saved, so concurrent submissions can't both spend it.
+func checkSecondFactor(svcs services.Services, kvs services.KeyValueStore, user *services.User, code string, skew int) bool {
+	code = strings.TrimSpace(code)
+	if code == "" || !user.HasTOTP() {
+		return false
+	}
+
+	if useTOTPCode(kvs, user.ID, user.TOTPSecret, code, skew) {
+		return true
+	}
+
+	if !user.UseRecoveryCode(code) {
+		return false
+	}
+
+	if err := kvs.CheckAndSet(kRecoveryUsedNamespace, user.ID+":"+services.HashRecoveryCode(code), true, services.NoExpiration); err != nil {
+		log.Printf("[Error] Reused recovery code for user (%s).", user.ID)
+		return false
+	}
+
+	if err := svcs.Users().Update(*user); err != nil {
+		log.Printf("[Error] Failed to spend recovery code - %v", err)
+		return false
+	}
+
+	return true
+}
+
+// useTOTPCode verifies code and records the time step it matched, so the
+// same code can't be replayed while it is still inside the skew window.
+func useTOTPCode(kvs services.KeyValueStore, uid, secret, code string, skew int) bool {
+	counter, ok := helpers.VerifyTOTP(secret, code, time.Now(), skew)
+	if !ok {
+		return false
+	}
+
+	ttl := time.Duration(2*skew+2) * helpers.TOTPStep
+	if err := kvs.CheckAndSet(kTOTPUsedNamespace, fmt.Sprintf("%s:%d", uid, counter), true, ttl); err != nil {
+		log.Printf("[Error] Replayed TOTP code for user (%s).", uid)
+		return false
+	}
+
+	return true
+}
+
+func readMFAPending(kvs services.KeyValueStore, rid string) (mfaPending, error) {
+	return asMFAPending(kvs.Read(kMFAPendingNamespace, rid))
+}
+
+// takeMFAPending removes the request while an attempt is checked; a failed
+// attempt puts it back.
+func takeMFAPending(kvs services.KeyValueStore, rid string) (mfaPending, error) {
+	return asMFAPending(kvs.ReadAndRemove(kMFAPendingNamespace, rid))
+}
+
+func asMFAPending(value any, err error) (mfaPending, error) {
+	if err != nil {
+		return mfaPending{}, err
+	}
+
+	pending, ok := value.(mfaPending)
+	if !ok {
+		return mfaPending{}, kSecondFactorError
+	}
+
+	return pending, nil
+}
+
+// Recovery codes look like 'abcde-12345'
+func generateRecoveryCodes(count int) ([]string, error) {
+	codes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		code, err := helpers.GenerateStringSecure(kRecoveryCodeLength, helpers.AlphaLower+helpers.Numeric)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code[:kRecoveryCodeLength/2]+"-"+code[kRecoveryCodeLength/2:])
+	}
+
+	return codes, nil
+}
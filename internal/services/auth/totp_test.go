@@ -0,0 +1,78 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"sync"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/helpers"
+	"shiftylogic.dev/site-plat/internal/services"
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestCheckSecondFactorRecoveryCode(t *testing.T) {
+	svcs, kvs := testServices()
+
+	user, err := services.NewUser("dude@example.com", "abides")
+	test.NoError(t, err, "creating user")
+	user.TOTPSecret, err = helpers.GenerateTOTPSecret()
+	test.NoError(t, err, "generating TOTP secret")
+	user.SetRecoveryCodes([]string{"abcde-12345", "fghij-67890"})
+	withTestUsers(svcs, kvs, user)
+
+	// Both submissions load the user before either has saved it
+	first, err := svcs.Users().User(user.ID)
+	test.NoError(t, err, "loading user")
+	second, err := svcs.Users().User(user.ID)
+	test.NoError(t, err, "loading user")
+
+	test.Require(t, checkSecondFactor(svcs, kvs, &first, "abcde-12345", 1), "recovery code is accepted")
+	test.Require(t, !checkSecondFactor(svcs, kvs, &second, "ABCDE12345", 1), "recovery code is spent")
+
+	saved, err := svcs.Users().User(user.ID)
+	test.NoError(t, err, "loading user")
+	test.Expect(t, 1, len(saved.RecoveryCodes), "spent code is removed")
+
+	// Racing submissions of the other code
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := 0; i < 8; i++ {
+		u, err := svcs.Users().User(user.ID)
+		test.NoError(t, err, "loading user")
+
+		wg.Add(1)
+		go func(u services.User) {
+			defer wg.Done()
+			if checkSecondFactor(svcs, kvs, &u, "fghij-67890", 1) {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	test.Expect(t, 1, accepted, "a recovery code works once")
+}
@@ -0,0 +1,116 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package auth
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"shiftylogic.dev/site-plat/internal/services"
+)
+
+const (
+	kAMRPassword = "pwd"
+
+	// RFC 6750 error codes
+	kInvalidTokenError      = "invalid_token"
+	kInsufficientScopeError = "insufficient_scope"
+)
+
+var (
+	// The claims each standard scope releases (OpenID Connect Core, Section 5.4)
+	kScopeClaims = map[string][]string{
+		"profile": {
+			"name", "family_name", "given_name", "middle_name", "nickname", "preferred_username",
+			"profile", "picture", "website", "gender", "birthdate", "zoneinfo", "locale", "updated_at",
+		},
+		"email":   {"email", "email_verified"},
+		"address": {"address"},
+		"phone":   {"phone_number", "phone_number_verified"},
+	}
+)
+
+// UserInfo returns the claims about the token's subject that its scopes allow.
+// It sits behind RequireAccessToken.
+func UserInfo() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		svcs := services.ServicesFromContext(r.Context())
+		claims := AccessTokenFromContext(r.Context())
+
+		if !hasScope(claims.Scope, kScopeOpenID) {
+			writeBearerError(w, http.StatusForbidden, kInsufficientScopeError, "openid scope required")
+			return
+		}
+
+		all, err := svcs.Authorizer().UserClaims(claims.Subject)
+		if err != nil {
+			log.Printf("[Error] Failed to fetch user claims - %v", err)
+			writeBearerError(w, http.StatusUnauthorized, kInvalidTokenError, "")
+			return
+		}
+
+		released := map[string]any{"sub": claims.Subject}
+		for _, scope := range strings.Fields(claims.Scope) {
+			for _, name := range kScopeClaims[scope] {
+				if v, ok := all[name]; ok {
+					released[name] = v
+				}
+			}
+		}
+
+		writeJSON(w, http.StatusOK, released)
+	}
+}
+
+// writeBearerError follows RFC 6750 (Section 3). A request without any token
+// just gets the challenge.
+func writeBearerError(w http.ResponseWriter, status int, errS, desc string) {
+	writeChallenge(w, kTokenTypeBearer, nil, status, errS, desc)
+}
+
+// writeChallenge writes an RFC 6750 style error for any token scheme, with
+// params placed ahead of the error.
+func writeChallenge(w http.ResponseWriter, scheme string, params []string, status int, errS, desc string) {
+	if errS != "" {
+		params = append(params, fmt.Sprintf("error=%q", errS))
+	}
+	if desc != "" {
+		params = append(params, fmt.Sprintf("error_description=%q", desc))
+	}
+
+	challenge := scheme
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+
+	if errS == "" {
+		w.WriteHeader(status)
+		return
+	}
+
+	writeJSON(w, status, errorResponse{Error: errS, Description: desc})
+}
@@ -0,0 +1,243 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package services
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	ClientTypePublic       = "public"
+	ClientTypeConfidential = "confidential"
+
+	// Key-value store namespace for clients that aren't part of the config
+	ClientNamespace = "oauth_client"
+)
+
+var (
+	// Grants a client gets when its registration doesn't list any
+	DefaultGrantTypes = []string{"authorization_code", "refresh_token"}
+
+	kErrorUnknownClient   = errors.New("unknown client")
+	kErrorStaticClient    = errors.New("client is defined by the config")
+	kErrorNoClientStorage = errors.New("client registry has no store")
+)
+
+// A registered OAuth client
+type Client struct {
+	ID   string `json:"id" yaml:"ID"`
+	Type string `json:"type" yaml:"Type"`
+
+	// Hex encoded SHA-256 of the client secret (see HashClientSecret);
+	// confidential clients only
+	SecretHash string `json:"secretHash" yaml:"SecretHash"`
+	// The token_endpoint_auth_method the client must use. Empty lets a
+	// confidential client use any method it has credentials for.
+	AuthMethod string `json:"authMethod" yaml:"AuthMethod"`
+	// Only accept authorization requests pushed to the PAR endpoint (RFC 9126)
+	RequirePAR bool `json:"requirePAR" yaml:"RequirePAR"`
+
+	// Redirect URIs are compared exactly, no prefix or pattern matching
+	RedirectURIs []string `json:"redirectURIs" yaml:"RedirectURIs"`
+	GrantTypes   []string `json:"grantTypes" yaml:"GrantTypes"`
+	// Upper bound on the scopes the client may request. Empty means no limit
+	// on what users can grant, but nothing at all for client_credentials.
+	Scopes []string `json:"scopes" yaml:"Scopes"`
+
+	// Shown to users on the login and consent pages
+	Name    string `json:"name" yaml:"Name"`
+	LogoURI string `json:"logoURI" yaml:"LogoURI"`
+}
+
+type ClientRegistry interface {
+	Client(id string) (Client, error)
+
+	// Dynamically registered clients. Clients from the config can't be
+	// changed this way.
+	Register(client Client) error
+	Update(client Client) error
+	Unregister(id string) error
+}
+
+// HashClientSecret produces the SecretHash stored for a client. Client
+// secrets are long random strings, so a plain hash is enough to keep them
+// out of config files.
+func HashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+/**
+ *
+ * Helper methods on Client struct
+ *
+ **/
+
+func (c Client) IsConfidential() bool {
+	return c.Type == ClientTypeConfidential
+}
+
+func (c Client) VerifySecret(secret string) bool {
+	if !c.IsConfidential() || c.SecretHash == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(c.SecretHash)), []byte(HashClientSecret(secret))) == 1
+}
+
+func (c Client) AllowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Client) AllowsGrant(grant string) bool {
+	allowed := c.GrantTypes
+	if len(allowed) == 0 {
+		allowed = DefaultGrantTypes
+	}
+
+	for _, g := range allowed {
+		if g == grant {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsScope reports whether every scope in the space separated list is one
+// the client may ask users for.
+func (c Client) AllowsScope(scope string) bool {
+	if len(c.Scopes) == 0 {
+		return true
+	}
+
+	allowed := make(map[string]bool)
+	for _, s := range c.Scopes {
+		allowed[s] = true
+	}
+
+	for _, s := range strings.Fields(scope) {
+		if !allowed[s] {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+ *
+ * A simple ClientRegistry that serves clients from the config first and the
+ * key-value store (if any) second.
+ *
+ **/
+
+type SimpleClientRegistry struct {
+	Static map[string]Client
+	KVS    KeyValueStore
+}
+
+func NewClientRegistry(clients []Client, kvs KeyValueStore) *SimpleClientRegistry {
+	static := make(map[string]Client)
+	for _, c := range clients {
+		static[c.ID] = c
+	}
+
+	return &SimpleClientRegistry{Static: static, KVS: kvs}
+}
+
+func (reg *SimpleClientRegistry) Client(id string) (Client, error) {
+	if c, ok := reg.Static[id]; ok {
+		return c, nil
+	}
+
+	if reg.KVS == nil || id == "" {
+		return Client{}, kErrorUnknownClient
+	}
+
+	value, err := reg.KVS.Read(ClientNamespace, id)
+	if err != nil {
+		return Client{}, kErrorUnknownClient
+	}
+
+	c, ok := value.(Client)
+	if !ok {
+		return Client{}, kErrorUnknownClient
+	}
+
+	return c, nil
+}
+
+func (reg *SimpleClientRegistry) Register(client Client) error {
+	if err := reg.checkWritable(client.ID); err != nil {
+		return err
+	}
+
+	return reg.KVS.CheckAndSet(ClientNamespace, client.ID, client, NoExpiration)
+}
+
+func (reg *SimpleClientRegistry) Update(client Client) error {
+	if err := reg.checkWritable(client.ID); err != nil {
+		return err
+	}
+
+	if _, err := reg.KVS.Read(ClientNamespace, client.ID); err != nil {
+		return kErrorUnknownClient
+	}
+
+	return reg.KVS.Set(ClientNamespace, client.ID, client, NoExpiration)
+}
+
+func (reg *SimpleClientRegistry) Unregister(id string) error {
+	if err := reg.checkWritable(id); err != nil {
+		return err
+	}
+
+	if _, err := reg.KVS.ReadAndRemove(ClientNamespace, id); err != nil {
+		return kErrorUnknownClient
+	}
+
+	return nil
+}
+
+func (reg *SimpleClientRegistry) checkWritable(id string) error {
+	if _, ok := reg.Static[id]; ok {
+		return kErrorStaticClient
+	}
+
+	if reg.KVS == nil {
+		return kErrorNoClientStorage
+	}
+
+	return nil
+}
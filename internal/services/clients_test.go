@@ -0,0 +1,52 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package services
+
+import (
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestClientSecret(t *testing.T) {
+	c := Client{ID: "svc", Type: ClientTypeConfidential, SecretHash: HashClientSecret("s3cret")}
+	test.Require(t, c.VerifySecret("s3cret"), "matching secret should verify")
+	test.Require(t, !c.VerifySecret("s3cret "), "altered secret should not verify")
+
+	c.Type = ClientTypePublic
+	test.Require(t, !c.VerifySecret("s3cret"), "public clients have no secret")
+}
+
+func TestClientAllowances(t *testing.T) {
+	c := Client{ID: "app", RedirectURIs: []string{"https://app/cb"}, Scopes: []string{"read", "write"}}
+
+	test.Require(t, c.AllowsRedirect("https://app/cb"), "registered redirect")
+	test.Require(t, !c.AllowsRedirect("https://app/cb/"), "redirects match exactly")
+
+	test.Require(t, c.AllowsGrant("authorization_code"), "default grants include authorization_code")
+	test.Require(t, !c.AllowsGrant("client_credentials"), "default grants exclude client_credentials")
+
+	test.Require(t, c.AllowsScope("write read"), "subset of allowed scopes")
+	test.Require(t, !c.AllowsScope("read admin"), "scope outside the allowance")
+	test.Require(t, Client{}.AllowsScope("anything"), "no scope list means no limit")
+}
@@ -23,7 +23,9 @@
 package services
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"io/fs"
 	"log"
 	"os"
@@ -60,6 +62,13 @@ type StaticConfig struct {
 type TLSConfig struct {
 	Certificate string `json:"certificate" yaml:"Certificate"`
 	Key         string `json:"key" yaml:"Key"`
+
+	// Client certificates (mutual TLS). ClientAuth is one of none, request,
+	// require, verify-if-given or require-and-verify; the verify modes check
+	// certificates against the PEM bundle in ClientCAs. Clients using
+	// self-signed certificates need request or require.
+	ClientAuth string `json:"clientAuth" yaml:"ClientAuth"`
+	ClientCAs  string `json:"clientCAs" yaml:"ClientCAs"`
 }
 
 func DefaultConfig() Config {
@@ -144,3 +153,20 @@ func (cfg StaticConfig) FS() fs.FS {
 func (cfg TLSConfig) Enabled() bool {
 	return cfg.Certificate != "" && cfg.Key != ""
 }
+
+func (cfg TLSConfig) ClientAuthType() (tls.ClientAuthType, error) {
+	switch cfg.ClientAuth {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-and-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+
+	return tls.NoClientCert, fmt.Errorf("unknown client auth mode (%s)", cfg.ClientAuth)
+}
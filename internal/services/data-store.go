@@ -22,7 +22,13 @@
 
 package services
 
-import "time"
+import (
+	"math"
+	"time"
+)
+
+// Pass as the ttl to keep an item until it is explicitly removed
+const NoExpiration time.Duration = math.MaxInt64
 
 type KeyValueStore interface {
 	Read(ns, key string) (any, error)
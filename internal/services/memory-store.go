@@ -52,6 +52,19 @@ type memoryItem struct {
 	value any
 }
 
+// A zero purge time marks an item stored with NoExpiration
+func newMemoryItem(value any, ttl time.Duration) *memoryItem {
+	item := &memoryItem{value: value}
+	if ttl != NoExpiration {
+		item.purge = time.Now().Add(ttl)
+	}
+	return item
+}
+
+func (item *memoryItem) expired(now time.Time) bool {
+	return !item.purge.IsZero() && item.purge.Before(now)
+}
+
 type memStore struct {
 	scopes sync.Map
 }
@@ -81,7 +94,7 @@ func (s *memStore) collect() {
 	s.scopes.Range(func(ns, value any) bool {
 		scoped := value.(*sync.Map)
 		scoped.Range(func(key, value any) bool {
-			if value.(memoryItem).purge.Before(now) {
+			if value.(*memoryItem).expired(now) {
 				_ = scoped.CompareAndDelete(key, value)
 			}
 			return true
@@ -101,11 +114,11 @@ func (store *memStore) Read(ns, key string) (any, error) {
 		return nil, kErrorInvalidKey
 	}
 
-	if item.(memoryItem).purge.Before(time.Now()) {
+	if item.(*memoryItem).expired(time.Now()) {
 		return nil, kErrorExpiredItem
 	}
 
-	return item.(memoryItem).value, nil
+	return item.(*memoryItem).value, nil
 }
 
 func (store *memStore) ReadAndRemove(ns, key string) (any, error) {
@@ -119,11 +132,11 @@ func (store *memStore) ReadAndRemove(ns, key string) (any, error) {
 		return nil, kErrorInvalidKey
 	}
 
-	if item.(memoryItem).purge.Before(time.Now()) {
+	if item.(*memoryItem).expired(time.Now()) {
 		return nil, kErrorExpiredItem
 	}
 
-	return item.(memoryItem).value, nil
+	return item.(*memoryItem).value, nil
 }
 
 func (store *memStore) CheckAndSet(ns, key string, value any, ttl time.Duration) error {
@@ -132,10 +145,7 @@ func (store *memStore) CheckAndSet(ns, key string, value any, ttl time.Duration)
 		scoped, _ = store.scopes.LoadOrStore(ns, new(sync.Map))
 	}
 
-	_, loaded := scoped.(*sync.Map).LoadOrStore(key, memoryItem{
-		purge: time.Now().Add(ttl),
-		value: value,
-	})
+	_, loaded := scoped.(*sync.Map).LoadOrStore(key, newMemoryItem(value, ttl))
 
 	if loaded {
 		return kErrorItemAlreadyExists
@@ -150,10 +160,7 @@ func (store *memStore) Set(ns, key string, value any, ttl time.Duration) error {
 		scoped, _ = store.scopes.LoadOrStore(ns, new(sync.Map))
 	}
 
-	scoped.(*sync.Map).Store(key, memoryItem{
-		purge: time.Now().Add(ttl),
-		value: value,
-	})
+	scoped.(*sync.Map).Store(key, newMemoryItem(value, ttl))
 
 	return nil
 }
@@ -169,10 +176,7 @@ func (store *memStore) Refresh(ns, key string, ttl time.Duration) error {
 		return kErrorInvalidKey
 	}
 
-	newItem := memoryItem{
-		purge: time.Now().Add(ttl),
-		value: item.(memoryItem).value,
-	}
+	newItem := newMemoryItem(item.(*memoryItem).value, ttl)
 
 	if !scoped.(*sync.Map).CompareAndSwap(key, item, newItem) {
 		return kErrorItemChanged
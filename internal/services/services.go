@@ -31,28 +31,54 @@ import (
 
 const (
 	ServicesContextKey = "sl.services"
+
+	// Key-value store namespaces shared between the authorizer and the auth service
+	AuthCodeNamespace = "auth_code"
 )
 
 type AuthCodeData struct {
 	UID             string
+	ClientID        string
 	RedirectURI     string
 	Scope           string
 	State           string
 	Challenge       string
 	ChallengeMethod string
+	Nonce           string
+	Prompt          string
+	ResponseMode    string
+
+	// When and how the user authenticated (OpenID Connect auth_time / amr)
+	AuthTime time.Time
+	AMR      []string
+
+	// Thumbprint of the DPoP key (RFC 9449) the grant's tokens are bound to
+	JKT string
+	// Thumbprint of the client certificate (RFC 8705) the access tokens are
+	// bound to
+	X5T string
 }
 
 type Authorizer interface {
 	GenerateAuthorizationRequest(data AuthCodeData, ttl time.Duration) (string, error)
-	GenerateQRRequest(ttl time.Duration) (string, string, string, error)
+
+	// QR code logins. The generated token is bound to a pending authorization
+	// request (rid); verification checks the HMAC and age and returns that rid.
+	GenerateQRRequest(rid string, ttl time.Duration) (string, string, string, error)
+	VerifyQRRequest(ts, token, hash string, ttl time.Duration) (string, error)
 
 	Authenticate(user, pwd string) (string, error)
+	AuthenticateClient(cid, secret string) (Client, error)
 	ValidateClient(cid, redir string) bool
+
+	UserClaims(uid string) (map[string]any, error)
 }
 
 type Services interface {
 	Ephemeral() DataStore
 	Authorizer() Authorizer
+	Clients() ClientRegistry
+	Users() UserDirectory
 }
 
 func ServicesFromContext(ctx context.Context) Services {
@@ -75,6 +101,8 @@ func WithServices(svcs Services) web.RouterOptionFunc {
 type ServicesContainer struct {
 	EphemeralStore DataStore
 	Authy          Authorizer
+	Registry       ClientRegistry
+	Directory      UserDirectory
 }
 
 func (svcs ServicesContainer) Ephemeral() DataStore {
@@ -84,3 +112,11 @@ func (svcs ServicesContainer) Ephemeral() DataStore {
 func (svcs ServicesContainer) Authorizer() Authorizer {
 	return svcs.Authy
 }
+
+func (svcs ServicesContainer) Clients() ClientRegistry {
+	return svcs.Registry
+}
+
+func (svcs ServicesContainer) Users() UserDirectory {
+	return svcs.Directory
+}
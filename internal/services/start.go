@@ -23,6 +23,7 @@
 package services
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 
@@ -38,6 +39,15 @@ func Start(config Config, router web.Router) {
 
 	if config.TLS.Enabled() {
 		options = append(options, web.WithTLS(config.TLS.Certificate, config.TLS.Key))
+
+		mode, err := config.TLS.ClientAuthType()
+		if err != nil {
+			log.Fatalf("[ERROR] Invalid TLS configuration: %v\n", err)
+		}
+
+		if mode != tls.NoClientCert {
+			options = append(options, web.WithClientCertificates(mode, config.TLS.ClientCAs))
+		}
 	}
 
 	//
@@ -0,0 +1,393 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+	"shiftylogic.dev/site-plat/internal/helpers"
+)
+
+const (
+	// Key-value store namespace for user records changed at runtime (e.g.
+	// password hashes upgraded on login)
+	UserNamespace = "user"
+
+	kUserIDSize = 24
+)
+
+var (
+	kErrorUnknownUser        = errors.New("unknown user")
+	kErrorBadPassword        = errors.New("invalid user or password")
+	kErrorDuplicateUser      = errors.New("username already taken")
+	kErrorUnknownUsersFormat = errors.New("unknown users file format")
+	kErrorNoUserStorage      = errors.New("user directory has no store")
+)
+
+type User struct {
+	// Stable identifier, used as the token subject
+	ID       string `json:"id" yaml:"ID"`
+	Username string `json:"username" yaml:"Username"`
+	// Encoded hash from helpers.HashPassword
+	PasswordHash string `json:"passwordHash" yaml:"PasswordHash"`
+
+	Name          string `json:"name" yaml:"Name"`
+	Email         string `json:"email" yaml:"Email"`
+	EmailVerified bool   `json:"emailVerified" yaml:"EmailVerified"`
+
+	// Any other OpenID Connect claims to release for the user
+	Claims map[string]any `json:"claims,omitempty" yaml:"Claims,omitempty"`
+
+	// Second factor: base32 TOTP secret and hashes of unused recovery codes
+	TOTPSecret    string   `json:"totpSecret,omitempty" yaml:"TOTPSecret,omitempty"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty" yaml:"RecoveryCodes,omitempty"`
+}
+
+type UserDirectory interface {
+	User(id string) (User, error)
+	Authenticate(username, password string) (User, error)
+
+	// Update replaces an existing user's record (e.g. after enrolling a
+	// second factor)
+	Update(user User) error
+}
+
+// The on-disk layout of a users file
+type UsersFile struct {
+	Users []User `json:"users" yaml:"Users"`
+}
+
+// NewUser creates a user with a fresh ID and the given password.
+func NewUser(username, password string) (User, error) {
+	id, err := helpers.GenerateStringSecure(kUserIDSize, helpers.AlphaNumeric)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := User{ID: id, Username: username}
+	if err := user.SetPassword(password); err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+/**
+ *
+ * Helper methods on User struct
+ *
+ **/
+
+func (u *User) SetPassword(password string) error {
+	hash, err := helpers.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.PasswordHash = hash
+	return nil
+}
+
+func (u User) HasTOTP() bool {
+	return u.TOTPSecret != ""
+}
+
+// SetRecoveryCodes replaces the user's recovery codes. Only hashes are kept.
+func (u *User) SetRecoveryCodes(codes []string) {
+	u.RecoveryCodes = make([]string, 0, len(codes))
+	for _, c := range codes {
+		u.RecoveryCodes = append(u.RecoveryCodes, HashRecoveryCode(c))
+	}
+}
+
+// UseRecoveryCode reports whether code is one of the user's unused recovery
+// codes and, if so, removes it.
+func (u *User) UseRecoveryCode(code string) bool {
+	hash := HashRecoveryCode(code)
+	for i, c := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(hash)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// HashRecoveryCode produces the hash stored for a recovery code. Recovery
+// codes are random, so a plain hash is enough. Dashes and case are ignored
+// since people type these in by hand.
+func HashRecoveryCode(code string) string {
+	return HashClientSecret(strings.ToLower(strings.ReplaceAll(code, "-", "")))
+}
+
+// OIDCClaims are the standard claims for the user plus any extras.
+func (u User) OIDCClaims() map[string]any {
+	claims := make(map[string]any)
+	for k, v := range u.Claims {
+		claims[k] = v
+	}
+
+	claims["sub"] = u.ID
+	claims["preferred_username"] = u.Username
+	if u.Name != "" {
+		claims["name"] = u.Name
+	}
+	if u.Email != "" {
+		claims["email"] = u.Email
+		claims["email_verified"] = u.EmailVerified
+	}
+
+	return claims
+}
+
+/**
+ *
+ * Users file helpers (YAML or JSON, picked by extension like LoadConfig)
+ *
+ **/
+
+func ReadUsersFile(file string) (UsersFile, error) {
+	var users UsersFile
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return users, err
+	}
+
+	switch path.Ext(file) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &users)
+	case ".json":
+		err = json.Unmarshal(data, &users)
+	default:
+		err = kErrorUnknownUsersFormat
+	}
+
+	return users, err
+}
+
+func WriteUsersFile(file string, users UsersFile) error {
+	var data []byte
+	var err error
+
+	switch path.Ext(file) {
+	case ".yaml", ".yml":
+		data, err = yaml.Marshal(users)
+	case ".json":
+		data, err = json.MarshalIndent(users, "", "  ")
+	default:
+		err = kErrorUnknownUsersFormat
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Password hashes are in here, so keep it private
+	return os.WriteFile(file, data, 0600)
+}
+
+// Add appends a new user, refusing duplicate usernames.
+func (f *UsersFile) Add(user User) error {
+	if _, ok := f.Find(user.Username); ok {
+		return kErrorDuplicateUser
+	}
+
+	f.Users = append(f.Users, user)
+	return nil
+}
+
+// Find returns the index of the user with the given username.
+func (f *UsersFile) Find(username string) (int, bool) {
+	for i, u := range f.Users {
+		if strings.EqualFold(u.Username, username) {
+			return i, true
+		}
+	}
+
+	return -1, false
+}
+
+/**
+ *
+ * A UserDirectory serving the users file. Runtime changes (second factor
+ * enrollment, spent recovery codes, upgraded password hashes) are written
+ * back to the file so they survive a restart. A directory built without a
+ * file keeps them in the key-value store instead (which wins over the
+ * initial users).
+ *
+ **/
+
+type FileUserDirectory struct {
+	file  string
+	order []string
+	users map[string]User
+	names map[string]string
+	kvs   KeyValueStore
+	mu    sync.RWMutex
+
+	// Verified against when the username is unknown, so a miss costs as much
+	// as a wrong password
+	decoy     string
+	decoyOnce sync.Once
+}
+
+func NewUserDirectory(users UsersFile, kvs KeyValueStore) *FileUserDirectory {
+	dir := &FileUserDirectory{
+		users: make(map[string]User),
+		names: make(map[string]string),
+		kvs:   kvs,
+	}
+
+	for _, u := range users.Users {
+		dir.order = append(dir.order, u.ID)
+		dir.users[u.ID] = u
+		dir.names[strings.ToLower(u.Username)] = u.ID
+	}
+
+	return dir
+}
+
+func LoadUserDirectory(file string, kvs KeyValueStore) (*FileUserDirectory, error) {
+	if file == "" {
+		return NewUserDirectory(UsersFile{}, kvs), nil
+	}
+
+	users, err := ReadUsersFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := NewUserDirectory(users, kvs)
+	dir.file = file
+	return dir, nil
+}
+
+func (dir *FileUserDirectory) User(id string) (User, error) {
+	if dir.file == "" && dir.kvs != nil {
+		if value, err := dir.kvs.Read(UserNamespace, id); err == nil {
+			if u, ok := value.(User); ok {
+				return u, nil
+			}
+		}
+	}
+
+	dir.mu.RLock()
+	defer dir.mu.RUnlock()
+
+	u, ok := dir.users[id]
+	if !ok {
+		return User{}, kErrorUnknownUser
+	}
+
+	return u, nil
+}
+
+func (dir *FileUserDirectory) Authenticate(username, password string) (User, error) {
+	dir.mu.RLock()
+	id, ok := dir.names[strings.ToLower(username)]
+	dir.mu.RUnlock()
+
+	if !ok {
+		dir.burnDecoy(password)
+		return User{}, kErrorBadPassword
+	}
+
+	user, err := dir.User(id)
+	if err != nil {
+		return User{}, kErrorBadPassword
+	}
+
+	match, upgrade, err := helpers.VerifyPassword(user.PasswordHash, password)
+	if err != nil || !match {
+		return User{}, kErrorBadPassword
+	}
+
+	// Best effort; the login still succeeds if the upgrade can't be stored
+	if upgrade {
+		if err := user.SetPassword(password); err == nil {
+			_ = dir.Update(user)
+		}
+	}
+
+	return user, nil
+}
+
+// Update writes the user back to the users file, or to the key-value store
+// when there is no file. Nothing changes if the write fails.
+func (dir *FileUserDirectory) Update(user User) error {
+	if _, err := dir.User(user.ID); err != nil {
+		return err
+	}
+
+	if dir.file != "" {
+		return dir.save(user)
+	}
+
+	if dir.kvs == nil {
+		return kErrorNoUserStorage
+	}
+
+	return dir.kvs.Set(UserNamespace, user.ID, user, NoExpiration)
+}
+
+// save rewrites the users file with user replacing its old record, then
+// swaps the record in memory.
+func (dir *FileUserDirectory) save(user User) error {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	users := UsersFile{Users: make([]User, 0, len(dir.order))}
+	for _, id := range dir.order {
+		if id == user.ID {
+			users.Users = append(users.Users, user)
+		} else {
+			users.Users = append(users.Users, dir.users[id])
+		}
+	}
+
+	if err := WriteUsersFile(dir.file, users); err != nil {
+		return err
+	}
+
+	delete(dir.names, strings.ToLower(dir.users[user.ID].Username))
+	dir.names[strings.ToLower(user.Username)] = user.ID
+	dir.users[user.ID] = user
+	return nil
+}
+
+func (dir *FileUserDirectory) burnDecoy(password string) {
+	dir.decoyOnce.Do(func() {
+		dir.decoy, _ = helpers.HashPassword("decoy")
+	})
+
+	_, _, _ = helpers.VerifyPassword(dir.decoy, password)
+}
@@ -0,0 +1,88 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestUserDirectoryAuthenticate(t *testing.T) {
+	user, err := NewUser("Dude@example.com", "abides")
+	test.NoError(t, err, "creating user")
+
+	dir := NewUserDirectory(UsersFile{Users: []User{user}}, NewMemoryStore(context.Background()))
+
+	found, err := dir.Authenticate("dude@example.com", "abides")
+	test.NoError(t, err, "usernames are case insensitive")
+	test.Expect(t, user.ID, found.ID, "authenticate returns the stable user ID")
+
+	_, err = dir.Authenticate("dude@example.com", "bowling")
+	test.SpecificError(t, err, kErrorBadPassword, "wrong password")
+
+	_, err = dir.Authenticate("walter@example.com", "abides")
+	test.SpecificError(t, err, kErrorBadPassword, "unknown users look like wrong passwords")
+}
+
+func TestUsersFileAdd(t *testing.T) {
+	var users UsersFile
+	test.NoError(t, users.Add(User{ID: "1", Username: "dude"}), "first user")
+	test.SpecificError(t, users.Add(User{ID: "2", Username: "Dude"}), kErrorDuplicateUser, "duplicate username")
+}
+
+func TestUserRecoveryCodes(t *testing.T) {
+	var user User
+	user.SetRecoveryCodes([]string{"abcde-12345", "fghij-67890"})
+
+	test.Require(t, user.UseRecoveryCode("ABCDE12345"), "codes ignore case and dashes")
+	test.Require(t, !user.UseRecoveryCode("abcde-12345"), "codes are single use")
+	test.Expect(t, 1, len(user.RecoveryCodes), "spent code is removed")
+}
+
+func TestUserDirectoryUpdateWritesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.yaml")
+	test.NoError(t, WriteUsersFile(file, UsersFile{Users: []User{{ID: "1", Username: "dude"}, {ID: "2", Username: "walter"}}}), "writing users file")
+
+	dir, err := LoadUserDirectory(file, NewMemoryStore(context.Background()))
+	test.NoError(t, err, "loading users file")
+
+	user, err := dir.User("2")
+	test.NoError(t, err, "finding user")
+	user.TOTPSecret = "SECRET"
+	user.SetRecoveryCodes([]string{"abcde-12345"})
+	test.NoError(t, dir.Update(user), "updating user")
+
+	reloaded, err := LoadUserDirectory(file, NewMemoryStore(context.Background()))
+	test.NoError(t, err, "reloading users file")
+	found, err := reloaded.User("2")
+	test.NoError(t, err, "user survives a reload")
+	test.Expect(t, "SECRET", found.TOTPSecret, "second factor survives a reload")
+	test.Expect(t, 1, len(found.RecoveryCodes), "recovery codes survive a reload")
+	_, err = reloaded.User("1")
+	test.NoError(t, err, "other users are kept")
+
+	test.SpecificError(t, dir.Update(User{ID: "3", Username: "donny"}), kErrorUnknownUser, "only existing users are updated")
+}
@@ -32,8 +32,8 @@ var (
 	CorsDefaultOptions = CorsOptions{
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "DPoP", "X-CSRF-Token"},
+		ExposedHeaders:   []string{"DPoP-Nonce", "Link", "WWW-Authenticate"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}
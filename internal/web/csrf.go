@@ -0,0 +1,209 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package web
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	kCSRFContextKey = "sl.csrf"
+
+	kCSRFTokenSize         = 32
+	kCSRFDefaultCookieName = "sl_csrf"
+	kCSRFDefaultFieldName  = "csrf_token"
+	kCSRFDefaultHeaderName = "X-CSRF-Token"
+)
+
+type CSRFOptions struct {
+	// HMAC key the cookie is signed with; a random one is generated if empty
+	Key []byte
+
+	CookieName string
+	CookiePath string
+	Secure     bool
+
+	// Where unsafe requests carry the token: a form field or a header
+	FieldName  string
+	HeaderName string
+
+	// Called for rejected requests; defaults to a plain 403
+	FailureHandler http.HandlerFunc
+}
+
+/**
+ *
+ * CSRF protection using signed double-submit cookies. Every browser gets a
+ * random token in a signed, HttpOnly cookie; pages echo the token back in a
+ * hidden form field (see CSRFTemplateField) and unsafe requests are rejected
+ * unless the two match. The signature keeps a sibling (sub)domain from
+ * planting a token of its choosing.
+ *
+ **/
+type CSRF struct {
+	options CSRFOptions
+}
+
+type csrfState struct {
+	token string
+	field string
+}
+
+func NewCSRF(options CSRFOptions) *CSRF {
+	if len(options.Key) == 0 {
+		options.Key = make([]byte, sha256.Size)
+		if _, err := rand.Read(options.Key); err != nil {
+			log.Fatalf("[ERROR] Failed to generate CSRF key - %v", err)
+		}
+	}
+
+	if options.CookieName == "" {
+		options.CookieName = kCSRFDefaultCookieName
+	}
+
+	if options.CookiePath == "" {
+		options.CookiePath = "/"
+	}
+
+	if options.FieldName == "" {
+		options.FieldName = kCSRFDefaultFieldName
+	}
+
+	if options.HeaderName == "" {
+		options.HeaderName = kCSRFDefaultHeaderName
+	}
+
+	if options.FailureHandler == nil {
+		options.FailureHandler = func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+	}
+
+	return &CSRF{options: options}
+}
+
+// Handler makes sure the browser has a token, exposes it to the templates
+// through the request context and rejects unsafe methods that don't echo it.
+func (c *CSRF) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := c.cookieToken(r)
+
+		if !csrfSafeMethod(r.Method) {
+			sent := r.Header.Get(c.options.HeaderName)
+			if sent == "" {
+				sent = r.PostFormValue(c.options.FieldName)
+			}
+
+			if !ok || !hmac.Equal([]byte(sent), []byte(token)) {
+				log.Printf("[Error] CSRF token missing or invalid for %s %s", r.Method, r.URL.Path)
+				c.options.FailureHandler(w, r)
+				return
+			}
+		}
+
+		if !ok {
+			var err error
+			if token, err = newCSRFToken(); err != nil {
+				log.Printf("[Error] Failed to generate CSRF token - %v", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     c.options.CookieName,
+				Value:    token + "." + c.sign(token),
+				Path:     c.options.CookiePath,
+				Secure:   c.options.Secure || r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		state := csrfState{token: token, field: c.options.FieldName}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), kCSRFContextKey, state)))
+	})
+}
+
+// CSRFToken returns the token for the request, or "" outside of CSRF.Handler.
+func CSRFToken(r *http.Request) string {
+	state, _ := r.Context().Value(kCSRFContextKey).(csrfState)
+	return state.token
+}
+
+// CSRFTemplateField is the hidden input that carries the token in a form.
+func CSRFTemplateField(r *http.Request) template.HTML {
+	state, ok := r.Context().Value(kCSRFContextKey).(csrfState)
+	if !ok {
+		return ""
+	}
+
+	return template.HTML(`<input type="hidden" name="` + template.HTMLEscapeString(state.field) +
+		`" value="` + template.HTMLEscapeString(state.token) + `">`)
+}
+
+func (c *CSRF) cookieToken(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(c.options.CookieName)
+	if err != nil {
+		return "", false
+	}
+
+	token, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || token == "" || !hmac.Equal([]byte(sig), []byte(c.sign(token))) {
+		return "", false
+	}
+
+	return token, true
+}
+
+func (c *CSRF) sign(token string) string {
+	mac := hmac.New(sha256.New, c.options.Key)
+	mac.Write([]byte("csrf:" + token))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func newCSRFToken() (string, error) {
+	buf := make([]byte, kCSRFTokenSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// RFC 9110, Section 9.2.1
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+// MIT License
+//
+// Copyright (c) 2023 Robert Anderson
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"shiftylogic.dev/site-plat/internal/test"
+)
+
+func TestCSRFDoubleSubmit(t *testing.T) {
+	csrf := NewCSRF(CSRFOptions{Key: []byte("secret")})
+	handler := csrf.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(CSRFToken(r)))
+	}))
+
+	// A safe request hands out the token
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	test.Expect(t, http.StatusOK, w.Code, "GET is allowed without a token")
+
+	cookies := w.Result().Cookies()
+	test.Expect(t, 1, len(cookies), "token cookie is set")
+	token := w.Body.String()
+
+	post := func(token string, cookie *http.Cookie) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(url.Values{"csrf_token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	test.Expect(t, http.StatusOK, post(token, cookies[0]), "matching token is accepted")
+	test.Expect(t, http.StatusForbidden, post(token, nil), "token without cookie is rejected")
+	test.Expect(t, http.StatusForbidden, post("forged", cookies[0]), "wrong token is rejected")
+
+	forged := &http.Cookie{Name: cookies[0].Name, Value: "forged.sig"}
+	test.Expect(t, http.StatusForbidden, post("forged", forged), "unsigned cookie is rejected")
+}
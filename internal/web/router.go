@@ -54,6 +54,25 @@ func NewRouter(options ...RouterOptionFunc) Router {
 	return r
 }
 
+/**
+ *
+ * Reports whether the router (including mounted sub-routers) would serve
+ * the given method and path.
+ *
+ */
+func HasRoute(r Router, method, path string) bool {
+	return r.Match(chi.NewRouteContext(), method, path)
+}
+
+/**
+ *
+ * Returns the value captured for a {key} route pattern placeholder.
+ *
+ */
+func URLParam(r *http.Request, key string) string {
+	return chi.URLParam(r, key)
+}
+
 func DumpRouter(r Router) {
 	walker := func(method, route string, h http.Handler, mws ...func(http.Handler) http.Handler) error {
 		log.Printf("[Route] %s %s\n", method, route)
@@ -24,8 +24,10 @@ package web
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"log"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -68,3 +70,31 @@ func WithTLS(cert, key string) ServerOptionFunc {
 		}
 	}
 }
+
+// WithClientCertificates asks TLS clients for a certificate, checking it
+// against the PEM bundle in caFile when mode verifies certificates. It
+// adjusts the configuration made by WithTLS, so it must come after it.
+func WithClientCertificates(mode tls.ClientAuthType, caFile string) ServerOptionFunc {
+	return func(s *Server) {
+		if s.TLSConfig == nil {
+			log.Fatal("Client certificates require TLS to be configured first")
+		}
+
+		s.TLSConfig.ClientAuth = mode
+		if caFile == "" {
+			return
+		}
+
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			log.Fatalf("Failed to read client CA bundle: %v\n", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in client CA bundle (%s)\n", caFile)
+		}
+
+		s.TLSConfig.ClientCAs = pool
+	}
+}
@@ -125,7 +125,9 @@ func setupContextWithShutdown(server *Server) context.Context {
 		// Wait for a signal to stop server
 		<-sig
 
-		stopCtx, _ := context.WithTimeout(ctx, server.ShutdownTimeout)
+		stopCtx, cancel := context.WithTimeout(ctx, server.ShutdownTimeout)
+		defer cancel()
+
 		go func() {
 			<-stopCtx.Done()
 			if stopCtx.Err() == context.DeadlineExceeded {
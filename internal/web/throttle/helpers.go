@@ -27,3 +27,9 @@ import "github.com/cespare/xxhash/v2"
 func computeID(key string) uint64 {
 	return xxhash.Sum64([]byte(key))
 }
+
+// KeyID maps a string key (an account name, an address, ...) to the numeric
+// ID a LimitTracker counts against.
+func KeyID(key string) uint64 {
+	return computeID(key)
+}
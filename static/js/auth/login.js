@@ -1,5 +1,55 @@
 "use strict";
 
 (function() {
-    // TODO: Things go here
+    const kPollInterval = 2000;
+
+    let qr = {
+        img: null,
+        rid: "",
+        refresh: 0,
+        timers: [],
+        poll() {
+            fetch("./qrstatus?rid=" + encodeURIComponent(this.rid), { cache: "no-store" })
+                .then((resp) => resp.json())
+                .then((body) => {
+                    switch (body.status) {
+                    case "approved":
+                    case "denied":
+                        this.stop();
+                        window.location.assign("./qrlogin?rid=" + encodeURIComponent(this.rid));
+                        break;
+                    case "expired":
+                        // Start over with a fresh login request
+                        this.stop();
+                        window.location.reload();
+                        break;
+                    }
+                })
+                .catch(() => {});
+        },
+        reload() {
+            this.img.src = "./qrcode?rid=" + encodeURIComponent(this.rid) + "&t=" + Date.now();
+        },
+        stop() {
+            this.timers.forEach((t) => clearInterval(t));
+            this.timers = [];
+        },
+        init() {
+            this.img = document.getElementById("qrcode");
+            if (!this.img) {
+                return;
+            }
+
+            this.rid = this.img.dataset.rid;
+            this.refresh = parseInt(this.img.dataset.refresh, 10) || 0;
+
+            this.timers.push(setInterval(() => this.poll(), kPollInterval));
+            if (this.refresh > 0) {
+                // Swap in a new code a little before the current one expires
+                this.timers.push(setInterval(() => this.reload(), this.refresh * 800));
+            }
+        },
+    };
+
+    qr.init();
 })();